@@ -0,0 +1,140 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the lines written to an access log.
+type AccessLogFormat int
+
+// Access log formats.
+const (
+	// AccessLogCommon is the Common Log Format, as written by Apache and
+	// nginx: the remote host, identity, user, time, request line, status,
+	// and response size.
+	AccessLogCommon AccessLogFormat = iota
+	// AccessLogCombined is the Common Log Format, followed by the Referer
+	// and User-Agent request headers.
+	AccessLogCombined
+	// AccessLogCombinedCertificate is the Combined Log Format, followed by
+	// the subject common name of the certificate presented on the
+	// connection, as reported by ServedCertificate, or "-" without TLS.
+	AccessLogCombinedCertificate
+)
+
+// accessLogTimeFormat is the format of the time in an access log line.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// EnableAccessLog writes a line to w for every request, in the provided
+// format, once the request has been served.  Lines are written whole, so w may
+// be shared with other writers that do the same.  The access log is
+// middleware, registered with Use, so it only sees the requests that
+// middleware sees.
+func (s *Server) EnableAccessLog(w io.Writer, format AccessLogFormat) {
+	var mutex sync.Mutex
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := &accessLogWriter{ResponseWriter: rw}
+			next.ServeHTTP(recorder, r)
+
+			line := accessLogLine(r, recorder, start, format)
+			mutex.Lock()
+			io.WriteString(w, line)
+			mutex.Unlock()
+		})
+	})
+}
+
+// accessLogLine formats the access log line for the provided request.
+func accessLogLine(r *http.Request, recorder *accessLogWriter, start time.Time, format AccessLogFormat) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user := "-"
+	if username, _, ok := r.BasicAuth(); ok && username != "" {
+		user = username
+	}
+	size := "-"
+	if recorder.bytes > 0 {
+		size = strconv.FormatInt(recorder.bytes, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		host, user, start.Format(accessLogTimeFormat), r.Method, r.RequestURI, r.Proto, recorder.statusCode(), size)
+	if format == AccessLogCombined || format == AccessLogCombinedCertificate {
+		line += fmt.Sprintf(" %q %q", r.Referer(), r.UserAgent())
+	}
+	if format == AccessLogCombinedCertificate {
+		subject := "-"
+		if cert := ServedCertificate(r); cert != nil {
+			subject = cert.Subject.CommonName
+		}
+		line += fmt.Sprintf(" %q", subject)
+	}
+	return line + "\n"
+}
+
+// accessLogWriter records the status and size of a response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader implements the WriteHeader() method of the http.ResponseWriter
+// interface.
+func (w *accessLogWriter) WriteHeader(status int) {
+	// Informational responses are followed by the final response.
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements the Write() method of the http.ResponseWriter interface.
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements the Flush() method of the http.Flusher interface.
+func (w *accessLogWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack implements the Hijack() method of the http.Hijacker interface.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap returns the underlying http.ResponseWriter, for use by
+// http.ResponseController.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode returns the status of the response, which is 200 OK if the
+// handler wrote nothing.
+func (w *accessLogWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
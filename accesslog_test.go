@@ -0,0 +1,54 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestEnableAccessLog(t *testing.T) {
+	tests := []struct {
+		format   AccessLogFormat
+		expected *regexp.Regexp
+	}{
+		{AccessLogCommon, regexp.MustCompile(
+			`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /simple\?q=1 HTTP/1\.1" 200 8\n$`)},
+		{AccessLogCombined, regexp.MustCompile(
+			`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /simple\?q=1 HTTP/1\.1" 200 8 "http://example\.com/" "test-agent"\n$`)},
+		{AccessLogCombinedCertificate, regexp.MustCompile(
+			`^127\.0\.0\.1 - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /simple\?q=1 HTTP/1\.1" 200 8 "http://example\.com/" "test-agent" "-"\n$`)},
+	}
+	for _, test := range tests {
+		var log bytes.Buffer
+		server := testServer()
+		server.EnableAccessLog(&log, test.format)
+		if err := server.Listen(addrs[0]); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+		server.Serve()
+
+		req, err := http.NewRequest("GET", "http://"+addrs[0]+simpleRoute+"?q=1", nil)
+		if err != nil {
+			t.Fatalf("Expected no error creating the request, received '%v'.", err)
+		}
+		req.Close = true
+		req.Header.Set("Referer", "http://example.com/")
+		req.Header.Set("User-Agent", "test-agent")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		resp.Body.Close()
+		server.Shutdown()
+
+		// Ensure that the request was logged in the expected format.
+		if line := log.String(); !test.expected.MatchString(line) {
+			t.Errorf("Expected a line matching '%v', received '%v'.", test.expected, line)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// SetAllowedCIDRs restricts the listener for addr to connections from the
+// provided CIDR ranges, such as "10.0.0.0/8" or "2001:db8::/32".  Connections
+// from other addresses are closed as soon as they are accepted, before any TLS
+// handshake or request, and are counted as rejected with RejectedNotAllowed.
+// When the PROXY protocol is enabled for addr, the address of the proxy is
+// checked, rather than that of the original client.  The ranges are checked
+// from the next connection accepted for addr on, including by a listener that
+// replaces the current one, while connections that were already accepted are
+// not closed.  Without any ranges, the restriction is removed.  An error is
+// returned, and nothing changes, if any range can not be parsed.
+func (s *Server) SetAllowedCIDRs(addr string, cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	s.listeners.setAllowedNets(addr, nets)
+	return nil
+}
+
+// setAllowedNets restricts the listener for addr to connections from the
+// provided networks, or removes the restriction if there are none.
+func (l *listeners) setAllowedNets(addr string, nets []*net.IPNet) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(nets) == 0 {
+		delete(l.allowedNets, addr)
+		return
+	}
+	if l.allowedNets == nil {
+		l.allowedNets = make(map[string][]*net.IPNet)
+	}
+	l.allowedNets[addr] = nets
+}
+
+// allowed returns true if the listener for addr accepts connections from the
+// provided remote address.
+func (l *listeners) allowed(addr string, remoteAddr net.Addr) bool {
+	l.RLock()
+	nets, ok := l.allowedNets[addr]
+	l.RUnlock()
+	if !ok {
+		return true
+	}
+	return netsContain(nets, remoteAddr)
+}
+
+// parseCIDRs parses the provided CIDR ranges.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("server: invalid CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// netsContain returns true if the IP address of the provided remote address is
+// in any of the provided networks.
+func netsContain(nets []*net.IPNet, remoteAddr net.Addr) bool {
+	var ip net.IP
+	switch remote := remoteAddr.(type) {
+	case *net.TCPAddr:
+		ip = remote.IP
+	default:
+		host, _, err := net.SplitHostPort(remoteAddr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
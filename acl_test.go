@@ -0,0 +1,74 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetAllowedCIDRs(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.SetAllowedCIDRs(addrs[0], "127.0.0.2"); err == nil {
+		t.Error("Expected an error when setting an invalid CIDR.")
+	}
+	if err = server.SetAllowedCIDRs(addrs[0], "127.0.0.2/32", "::1/128"); err != nil {
+		t.Fatalf("Expected no error when setting allowed CIDRs, received '%v'.", err)
+	}
+	rejected := make(chan RejectionReason, 1)
+	server.OnConnectionRejected = func(remoteAddr string, reason RejectionReason) {
+		rejected <- reason
+	}
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that only the allowed address is served.
+	if err = requestFrom("127.0.0.2", addrs[0]); err != nil {
+		t.Errorf("Expected no error from an allowed address, received '%v'.", err)
+	}
+	if err = requestFrom("127.0.0.1", addrs[0]); err == nil {
+		t.Error("Expected an error from an address that is not allowed.")
+	}
+	select {
+	case reason := <-rejected:
+		if reason != RejectedNotAllowed {
+			t.Errorf("Expected the connection to be rejected as '%v', received '%v'.", RejectedNotAllowed, reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the rejection to be reported.")
+	}
+	if count := server.Stats().Rejections[RejectedNotAllowed]; count != 1 {
+		t.Errorf("Expected 1 rejected connection, found %v.", count)
+	}
+
+	// Ensure that the restriction can be removed.
+	if err = server.SetAllowedCIDRs(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when removing allowed CIDRs, received '%v'.", err)
+	}
+	if err = requestFrom("127.0.0.1", addrs[0]); err != nil {
+		t.Errorf("Expected no error once the restriction was removed, received '%v'.", err)
+	}
+}
+
+// requestFrom makes a plain HTTP/1.0 request, from the provided local address,
+// over a new connection to the given server.
+func requestFrom(localIP, addr string) error {
+	dialer := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP(localIP)},
+		Timeout:   5 * time.Second,
+	}
+	c, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return connRequest(c, simpleRoute)
+}
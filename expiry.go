@@ -0,0 +1,68 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// certExpiryCheckInterval is how often certificates are checked for expiry
+// once SetCertExpiryWarning has been called.
+const certExpiryCheckInterval = time.Hour
+
+// SetCertExpiryWarning checks the server's certificates once immediately, and
+// then hourly, calling fn with each certificate that expires within the
+// provided threshold, including those that have already expired.  A
+// certificate is reported on every check until it is replaced or removed.
+// Checking stops when the server is shut down, or when this is called again; a
+// threshold of zero, or a nil fn, only stops it.
+func (s *Server) SetCertExpiryWarning(threshold time.Duration, fn func(CertInfo)) {
+	s.expiryMutex.Lock()
+	defer s.expiryMutex.Unlock()
+
+	if s.stopExpiry != nil {
+		s.stopExpiry()
+		s.stopExpiry = nil
+	}
+	if threshold <= 0 || fn == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopExpiry = cancel
+	s.listeners.spawn(func() {
+		ticker := time.NewTicker(certExpiryCheckInterval)
+		defer ticker.Stop()
+		for {
+			deadline := time.Now().Add(threshold)
+			for _, cert := range s.Certificates() {
+				if ctx.Err() != nil {
+					return
+				}
+				if cert.NotAfter.Before(deadline) {
+					fn(cert)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// stopCertExpiryWarning stops checking certificates for expiry, if it was
+// started.
+func (s *Server) stopCertExpiryWarning() {
+	s.expiryMutex.Lock()
+	defer s.expiryMutex.Unlock()
+
+	if s.stopExpiry != nil {
+		s.stopExpiry()
+		s.stopExpiry = nil
+	}
+}
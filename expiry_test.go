@@ -0,0 +1,48 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetCertExpiryWarning(t *testing.T) {
+	server := testServer()
+	server.AllowInvalidCertificates = true
+	if err := server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	if err := server.AddTLSCertificateFromFile("./test/expired.localhost.crt", "./test/expired.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+
+	// Ensure that only the certificate within the threshold is reported.
+	warnings := make(chan CertInfo, 2)
+	server.SetCertExpiryWarning(30*24*time.Hour, func(cert CertInfo) {
+		warnings <- cert
+	})
+	select {
+	case cert := <-warnings:
+		if cert.CommonName != "expired.localhost" {
+			t.Errorf("Expected a warning for expired.localhost, received '%v'.", cert.CommonName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a warning for the expiring certificate.")
+	}
+	select {
+	case cert := <-warnings:
+		t.Errorf("Expected a single warning, also received '%v'.", cert.CommonName)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Ensure that checking stops on shutdown.
+	server.Shutdown()
+	server.expiryMutex.Lock()
+	if server.stopExpiry != nil {
+		t.Error("Expected expiry checking to stop on shutdown.")
+	}
+	server.expiryMutex.Unlock()
+}
@@ -0,0 +1,81 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SetTrustedProxies trusts the X-Forwarded-For header of requests from the
+// provided CIDR ranges, such as those of a reverse proxy in front of the
+// server.  For such requests, r.RemoteAddr becomes the address of the client,
+// which is the rightmost address in the header that is not itself a trusted
+// proxy, with a port of 0, as the client's port is not known.  The header of
+// requests from other addresses is ignored, as anyone can send it, as is a
+// header that can not be parsed.  This happens before the request reaches any
+// middleware, so the access log and rate limiting see the client's address.
+// Without any ranges, the header is no longer trusted.  An error is returned,
+// and nothing changes, if any range can not be parsed.
+func (s *Server) SetTrustedProxies(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	if len(nets) == 0 {
+		nets = nil
+	}
+
+	s.middlewareMutex.Lock()
+	s.trustedProxies = nets
+	s.middlewareMutex.Unlock()
+	return nil
+}
+
+// forwardedFor returns the address of the client that made the provided
+// request through the trusted proxies, and true, or false if the request was
+// not made by a trusted proxy, or did not pass through one.
+func forwardedFor(r *http.Request, trusted []*net.IPNet) (string, bool) {
+	peer := parseForwardedIP(r.RemoteAddr)
+	if peer == nil || !netsContain(trusted, &net.TCPAddr{IP: peer}) {
+		return "", false
+	}
+
+	// Each proxy appends the address it received the request from, so the
+	// rightmost untrusted address is the furthest that can be believed.
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var client net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return "", false
+		}
+		client = ip
+		if !netsContain(trusted, &net.TCPAddr{IP: ip}) {
+			break
+		}
+	}
+	if client == nil {
+		return "", false
+	}
+	return net.JoinHostPort(client.String(), "0"), true
+}
+
+// parseForwardedIP parses an IP address, with or without a port, such as an
+// address from the X-Forwarded-For header, which some proxies send with one.
+func parseForwardedIP(addr string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,82 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestSetTrustedProxies(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ServeMux.HandleFunc("/remote", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	if err = server.SetTrustedProxies("invalid"); err == nil {
+		t.Error("Expected an error for an invalid CIDR.")
+	}
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	remote := func(forwardedFor ...string) string {
+		req, err := http.NewRequest("GET", "http://"+addrs[0]+"/remote", nil)
+		if err != nil {
+			t.Fatalf("Expected no error creating the request, received '%v'.", err)
+		}
+		for _, value := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Expected no error reading the body, received '%v'.", err)
+		}
+		return string(body)
+	}
+
+	// Ensure that the header is ignored from an untrusted peer.
+	if err = server.SetTrustedProxies("192.0.2.0/24"); err != nil {
+		t.Fatalf("Expected no error setting trusted proxies, received '%v'.", err)
+	}
+	if addr := remote("198.51.100.1"); addr == "198.51.100.1:0" {
+		t.Errorf("Expected the header of an untrusted peer to be ignored, received '%v'.", addr)
+	}
+
+	// Ensure that the rightmost untrusted address is used from a trusted
+	// peer, and that spoofed addresses to its left are not.
+	if err = server.SetTrustedProxies("127.0.0.0/8", "10.0.0.0/8"); err != nil {
+		t.Fatalf("Expected no error setting trusted proxies, received '%v'.", err)
+	}
+	tests := []struct {
+		forwardedFor []string
+		remote       string
+	}{
+		{[]string{"198.51.100.1"}, "198.51.100.1:0"},
+		{[]string{"203.0.113.9, 198.51.100.1, 10.0.0.1"}, "198.51.100.1:0"},
+		{[]string{"203.0.113.9", "198.51.100.2:4321, 10.0.0.2"}, "198.51.100.2:0"},
+		{[]string{"[2001:db8::1]:4321"}, "[2001:db8::1]:0"},
+		{[]string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1:0"},
+	}
+	for _, test := range tests {
+		if addr := remote(test.forwardedFor...); addr != test.remote {
+			t.Errorf("Expected remote address '%v' for %q, received '%v'.", test.remote, test.forwardedFor, addr)
+		}
+	}
+
+	// Ensure that a header that can not be parsed is ignored.
+	if addr := remote("198.51.100.1, invalid"); addr == "198.51.100.1:0" {
+		t.Errorf("Expected an invalid header to be ignored, received '%v'.", addr)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+)
+
+// h2cUpgradeHandler returns a handler for the provided http.Server that
+// upgrades plain HTTP/1.1 requests asking for h2c to HTTP/2, as described in
+// RFC 7540 section 3.2, and passes every other request to the http.Server's
+// handler.
+//
+// h2c.NewHandler is not used, as the connections it upgrades are served by an
+// http.Server of their own that is never shut down, and so would hold up a
+// graceful shutdown until their clients closed them.  Instead, they are served
+// by a copy of the http.Server that is shut down along with it.
+func h2cUpgradeHandler(httpServer *http.Server) http.Handler {
+	upgraded := &http.Server{
+		ReadTimeout:    httpServer.ReadTimeout,
+		WriteTimeout:   httpServer.WriteTimeout,
+		IdleTimeout:    httpServer.IdleTimeout,
+		MaxHeaderBytes: httpServer.MaxHeaderBytes,
+		ErrorLog:       httpServer.ErrorLog,
+		HTTP2:          httpServer.HTTP2,
+	}
+	h2Server := &http2.Server{}
+	if httpServer.HTTP2 != nil {
+		h2Server.MaxConcurrentStreams = uint32(httpServer.HTTP2.MaxConcurrentStreams)
+	}
+	http2.ConfigureServer(upgraded, h2Server)
+	httpServer.RegisterOnShutdown(func() {
+		upgraded.Shutdown(context.Background())
+	})
+
+	handler := httpServer.Handler
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil || !isH2CUpgrade(r.Header) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		values := r.Header.Values("HTTP2-Settings")
+		if len(values) != 1 {
+			http.Error(w, "Invalid HTTP2-Settings header", http.StatusBadRequest)
+			return
+		}
+		settings, err := base64.RawURLEncoding.DecodeString(values[0])
+		if err != nil {
+			http.Error(w, "Invalid HTTP2-Settings header", http.StatusBadRequest)
+			return
+		}
+
+		// The body of the request can not be read once the connection has
+		// switched protocols, so it is read beforehand.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		c, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer c.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		if err = rw.Flush(); err != nil {
+			return
+		}
+		h2Server.ServeConn(&bufferedConn{Conn: c, reader: rw.Reader}, &http2.ServeConnOpts{
+			Context:        r.Context(),
+			Handler:        handler,
+			UpgradeRequest: r,
+			Settings:       settings,
+		})
+	})
+}
+
+// isH2CUpgrade returns true if the provided request headers ask to upgrade the
+// connection to HTTP/2.
+func isH2CUpgrade(h http.Header) bool {
+	return httpguts.HeaderValuesContainsToken(h["Upgrade"], "h2c") &&
+		httpguts.HeaderValuesContainsToken(h["Connection"], "HTTP2-Settings")
+}
+
+// bufferedConn is a connection whose reads begin with any data that was
+// already buffered from it.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read implements the Read() method of the net.Conn interface.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,39 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// RegisterHealthChecks registers liveness and readiness checks with the
+// server's ServeMux, at livePath and readyPath.  The liveness check always
+// responds with a 200 OK.  The readiness check responds with a 200 OK if ready
+// returns true, or if ready is nil, and a 503 Service Unavailable otherwise.
+// Once the server begins shutting down, including while BeforeShutdown runs,
+// the readiness check responds with a 503 Service Unavailable regardless, so
+// that load balancers stop routing new requests to the server while it drains.
+func (s *Server) RegisterHealthChecks(livePath, readyPath string, ready func() bool) {
+	s.HandleFunc(livePath, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	s.HandleFunc(readyPath, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case s.shuttingDown():
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		case ready != nil && !ready():
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, "ok\n")
+		}
+	})
+}
+
+// shuttingDown returns true if the server is shutting down.
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
@@ -0,0 +1,82 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRegisterHealthChecks(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	var ready int32
+	server.RegisterHealthChecks("/healthz", "/readyz", func() bool {
+		return atomic.LoadInt32(&ready) != 0
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	status := func(route string) int {
+		req, err := http.NewRequest("GET", "http://"+addrs[0]+route, nil)
+		if err != nil {
+			t.Fatalf("Expected no error creating the request, received '%v'.", err)
+		}
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Ensure that readiness follows the ready function.
+	if code := status("/healthz"); code != 200 {
+		t.Errorf("Expected the liveness check to respond with 200, received '%v'.", code)
+	}
+	if code := status("/readyz"); code != 503 {
+		t.Errorf("Expected the readiness check to respond with 503 before ready, received '%v'.", code)
+	}
+	atomic.StoreInt32(&ready, 1)
+	if code := status("/readyz"); code != 200 {
+		t.Errorf("Expected the readiness check to respond with 200 once ready, received '%v'.", code)
+	}
+
+	// Ensure that the server is no longer ready once it begins shutting down,
+	// while it is still alive.
+	var live, readiness int
+	server.BeforeShutdown = func() {
+		live, readiness = status("/healthz"), status("/readyz")
+	}
+	server.Shutdown()
+	server.BeforeShutdown = nil
+	if live != 200 {
+		t.Errorf("Expected the liveness check to respond with 200 while draining, received '%v'.", live)
+	}
+	if readiness != 503 {
+		t.Errorf("Expected the readiness check to respond with 503 while draining, received '%v'.", readiness)
+	}
+
+	// Ensure that the server is not ready once shut down, until it serves
+	// again.
+	recorder := httptest.NewRecorder()
+	server.ServeMux.ServeHTTP(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	if recorder.Code != 503 {
+		t.Errorf("Expected the readiness check to respond with 503 once shut down, received '%v'.", recorder.Code)
+	}
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+	if code := status("/readyz"); code != 200 {
+		t.Errorf("Expected the readiness check to respond with 200 once serving again, received '%v'.", code)
+	}
+}
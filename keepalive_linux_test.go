@@ -0,0 +1,107 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveProbing(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.KeepAliveIdle = 30 * time.Second
+	server.KeepAliveInterval = 5 * time.Second
+	server.KeepAliveCount = 3
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the keep-alive options were applied to the socket.
+	checkSocketOptions(t, server, map[int]int{
+		syscall.SO_KEEPALIVE:  1,
+		syscall.TCP_KEEPIDLE:  30,
+		syscall.TCP_KEEPINTVL: 5,
+		syscall.TCP_KEEPCNT:   3,
+	})
+}
+
+func TestTCPKeepAlivePeriod(t *testing.T) {
+	tests := []struct {
+		period   time.Duration
+		expected map[int]int
+	}{
+		// The period is used for both the idle time and the interval.
+		{20 * time.Second, map[int]int{
+			syscall.SO_KEEPALIVE:  1,
+			syscall.TCP_KEEPIDLE:  20,
+			syscall.TCP_KEEPINTVL: 20,
+		}},
+		// A negative period disables keep-alive.
+		{-1, map[int]int{
+			syscall.SO_KEEPALIVE: 0,
+		}},
+	}
+	for _, test := range tests {
+		server := testServer()
+		server.TCPKeepAlivePeriod = test.period
+		if err := server.Listen(addrs[0]); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+		server.Serve()
+		checkSocketOptions(t, server, test.expected)
+		server.Shutdown()
+	}
+}
+
+// checkSocketOptions connects to the server, and checks that the provided
+// socket options have the expected values on the accepted connection.
+func checkSocketOptions(t *testing.T, server *Server, expected map[int]int) {
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+
+	// Wait for the server to accept the connection.
+	localAddr := c.LocalAddr().String()
+	var accepted *conn
+	for i := 0; i < 100 && accepted == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		server.listeners.connsMutex.Lock()
+		for tracked := range server.listeners.conns {
+			if tracked.RemoteAddr().String() == localAddr {
+				accepted = tracked
+			}
+		}
+		server.listeners.connsMutex.Unlock()
+	}
+	if accepted == nil {
+		t.Fatal("Expected the server to accept the connection.")
+	}
+
+	rawConn, err := accepted.Conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Expected no error accessing the socket, received '%v'.", err)
+	}
+	rawConn.Control(func(fd uintptr) {
+		for opt, value := range expected {
+			level := syscall.IPPROTO_TCP
+			if opt == syscall.SO_KEEPALIVE {
+				level = syscall.SOL_SOCKET
+			}
+			actual, err := syscall.GetsockoptInt(int(fd), level, opt)
+			if err != nil {
+				t.Errorf("Expected no error reading socket option %v, received '%v'.", opt, err)
+			} else if actual != value {
+				t.Errorf("Expected socket option %v to be '%v', received '%v'.", opt, value, actual)
+			}
+		}
+	})
+}
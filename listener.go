@@ -5,14 +5,21 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
-	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // States that a listener can be in.
@@ -21,15 +28,54 @@ const (
 	stateServing   uint16 = 1 << iota
 	stateClosing   uint16 = 1 << iota
 	stateDetached  uint16 = 1 << iota
+	stateStopped   uint16 = 1 << iota
+)
+
+// minAcceptRetryDelay and maxAcceptRetryDelay bound the delay before retrying
+// to accept a connection after a temporary error.
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
 )
 
 // listener is an implementation of the net.Listener interface.
 type listener struct {
+	// These are accessed atomically, and must be 64-bit aligned.
+	acceptedConns  int64
+	activeConns    int64
+	servedRequests int64
+
 	net.Listener
 	manager              *listeners
 	stateMutex, tlsMutex sync.RWMutex
 	state                uint16
 	tlsConfig            *tls.Config
+	ownTLS               bool
+	closeOnce            sync.Once
+	// ticketKeys are the listener's session ticket keys, newest first, if
+	// they have been rotated.  They are guarded by tlsMutex.
+	ticketKeys [][32]byte
+	// ticketFallback is the TLS configuration the listener used before its
+	// keys were first rotated, which still decrypts the tickets it issued
+	// until enough keys have been rotated in.  It is guarded by tlsMutex.
+	ticketFallback *tls.Config
+
+	requestsMutex sync.Mutex
+	requests      int
+	drained       chan struct{}
+
+	// httpServer serves the listener's connections once it is serving.  It
+	// is guarded by stateMutex.
+	httpServer *http.Server
+	// handler, if set, handles the listener's requests instead of the
+	// server's ServeMux.  It is guarded by stateMutex.
+	handler http.Handler
+
+	// connLimit limits the number of connections the listener may have
+	// active at once, and is nil if there is no limit.  It is guarded by
+	// stateMutex.  closed is closed once the listener begins shutting down.
+	connLimit chan struct{}
+	closed    chan struct{}
 }
 
 // hasState returns true if the listener has any of the states provided.  This
@@ -46,124 +92,807 @@ func (l *listener) hasState(states ...uint16) bool {
 	return false
 }
 
+// setHandler sets the handler for the listener's requests, in place of the
+// server's ServeMux.
+func (l *listener) setHandler(handler http.Handler) {
+	l.stateMutex.Lock()
+	l.handler = handler
+	l.stateMutex.Unlock()
+}
+
+// ownHandler returns the handler for the listener's requests, or nil if they
+// are handled by the server's ServeMux.
+func (l *listener) ownHandler() http.Handler {
+	l.stateMutex.RLock()
+	defer l.stateMutex.RUnlock()
+	return l.handler
+}
+
 // configureTLS sets the TLS configuration for the listener.
 func (l *listener) configureTLS(config *tls.Config) {
 	l.tlsMutex.Lock()
 	if config == nil {
-		config = &tls.Config{}
+		l.tlsConfig = &tls.Config{}
 	} else {
-		*l.tlsConfig = *config
+		l.tlsConfig = config.Clone()
+		recordCertificates(l.tlsConfig)
 	}
+	// Rotated session ticket keys survive reconfiguration.
+	l.applySessionTicketKeys()
+	l.tlsMutex.Unlock()
+}
+
+// configureOwnTLS sets a TLS configuration for the listener that is
+// independent of the server's TLS configuration.
+func (l *listener) configureOwnTLS(config *tls.Config) {
+	l.configureTLS(config)
+	l.tlsMutex.Lock()
+	l.ownTLS = true
 	l.tlsMutex.Unlock()
 }
 
 // tlsConfigured returns true if TLS has been configured for the listener.
 func (l *listener) tlsConfigured() bool {
+	return l.serverTLSConfig() != nil
+}
+
+// serverTLSConfig returns the TLS configuration for the listener, or nil if TLS
+// has not been configured.
+func (l *listener) serverTLSConfig() *tls.Config {
 	l.tlsMutex.RLock()
 	defer l.tlsMutex.RUnlock()
-	return len(l.tlsConfig.Certificates) > 0
+	if len(l.tlsConfig.Certificates) == 0 && l.tlsConfig.GetCertificate == nil &&
+		l.tlsConfig.GetConfigForClient == nil {
+		return nil
+	}
+	return l.tlsConfig
+}
+
+// hasCertificateFor returns true if any of the listener's certificates are
+// valid for the provided server name.
+func (l *listener) hasCertificateFor(serverName string) bool {
+	l.tlsMutex.RLock()
+	defer l.tlsMutex.RUnlock()
+
+	// Certificates obtained on demand are assumed to cover any name.
+	if l.tlsConfig.GetCertificate != nil {
+		return true
+	}
+	for _, cert := range l.tlsConfig.Certificates {
+		leaf, err := leafCertificate(cert)
+		if err == nil && leaf.VerifyHostname(serverName) == nil {
+			return true
+		}
+	}
+	return false
 }
 
 // Accept implements the Accept() method of the net.Listener interface.
 func (l *listener) Accept() (c net.Conn, err error) {
-	c, err = l.Listener.Accept()
-	if err != nil {
-		if l.hasState(stateClosing) {
-			err = errShutdownRequested
+	var limit, slots, queue chan struct{}
+	var delay time.Duration
+	for {
+		if limit, err = l.acquireConn(); err != nil {
+			return
 		}
-		return
+		c, err = l.Listener.Accept()
+		if err != nil {
+			releaseConn(limit)
+			if l.hasState(stateClosing, stateStopped) {
+				err = errShutdownRequested
+				return
+			}
+			// Temporary errors, such as running out of file descriptors, are
+			// retried with an exponential backoff, as net/http does.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = minAcceptRetryDelay
+				} else if delay *= 2; delay > maxAcceptRetryDelay {
+					delay = maxAcceptRetryDelay
+				}
+				l.manager.server.logf("server: accept error on %v: %v; retrying in %v", l.address(), err, delay)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-l.closed:
+					err = errShutdownRequested
+					return
+				}
+			}
+			return
+		}
+		delay = 0
+		if !l.manager.allowed(l.address(), c.RemoteAddr()) {
+			releaseConn(limit)
+			l.manager.reject(c, RejectedNotAllowed)
+			continue
+		}
+
+		var reason RejectionReason
+		var ok bool
+		if slots, reason, ok = l.manager.acquireConn(); ok {
+			break
+		}
+		// The connection waits for capacity on its first read or write,
+		// rather than here, so that other connections are still accepted.
+		if queue = l.manager.connQueue(); queue != nil {
+			break
+		}
+		releaseConn(limit)
+		l.manager.reject(c, reason)
 	}
-	if l.tlsConfigured() {
-		c = tls.Server(c, l.tlsConfig)
+	if tcpConn, ok := c.(*net.TCPConn); ok {
+		l.manager.configureKeepAlive(tcpConn)
+	}
+	if l.manager.proxyProtocolRequired(l.address(), c) {
+		c = newProxyConn(c)
+	}
+	c = l.manager.trackConn(c, l, limit, slots, queue)
+	if config := l.serverTLSConfig(); config != nil {
+		tlsConn := tls.Server(c, config)
+		if timeout := l.manager.server.TLSHandshakeTimeout; timeout > 0 {
+			// The handshake is started here, rather than waiting for the
+			// http.Server to start it, so that it can be bounded.  The
+			// connection is closed if the context expires first.
+			l.manager.spawn(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				tlsConn.HandshakeContext(ctx)
+			})
+		}
+		c = tlsConn
 	}
 	return
 }
 
+// acquireConn reserves capacity for a new connection on the listener, blocking
+// until a connection closes if the listener is at its limit.  The returned
+// channel must be drained once the connection is closed, and is nil if the
+// listener's connections are not being limited.
+func (l *listener) acquireConn() (chan struct{}, error) {
+	l.stateMutex.RLock()
+	limit := l.connLimit
+	l.stateMutex.RUnlock()
+	if limit == nil {
+		return nil, nil
+	}
+
+	select {
+	case limit <- struct{}{}:
+		return limit, nil
+	case <-l.closed:
+		return nil, errShutdownRequested
+	}
+}
+
+// releaseConn releases capacity reserved for a connection from the provided
+// channel, if any.
+func releaseConn(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// setConnLimit limits the number of connections the listener may have active
+// at once.  A limit of zero or less removes the limit.  Connections that are
+// already active count against the limit they were accepted under.
+func (l *listener) setConnLimit(max int) {
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+
+	l.connLimit = nil
+	if max > 0 {
+		l.connLimit = make(chan struct{}, max)
+	}
+}
+
+// check verifies that the listener is able to accept connections, without
+// accepting one, so that clients that have already connected are not dropped.
+// Setting a deadline fails once the listener has been closed.  Listeners that
+// do not support deadlines are assumed to be able to accept connections.
+func (l *listener) check() error {
+	d, ok := l.Listener.(interface {
+		SetDeadline(t time.Time) error
+	})
+	if !ok {
+		return nil
+	}
+	return d.SetDeadline(time.Time{})
+}
+
+// address returns the address that the listener is known by.  Unix socket
+// listeners are prefixed with "unix:", matching the form accepted by Listen.
+func (l *listener) address() string {
+	if addr, ok := l.Addr().(*net.UnixAddr); ok {
+		return unixPrefix + addr.Name
+	}
+	return l.Addr().String()
+}
+
+// fd returns a duplicate of the file descriptor underlying the listener.  The
+// caller owns the duplicate, and is responsible for closing it.
+func (l *listener) fd() (uintptr, error) {
+	if sc, ok := l.Listener.(syscall.Conn); ok {
+		rawConn, err := sc.SyscallConn()
+		if err == nil {
+			var fd int
+			var dupErr error
+			if err = rawConn.Control(func(s uintptr) { fd, dupErr = syscall.Dup(int(s)) }); err == nil {
+				if dupErr != nil {
+					return 0, dupErr
+				}
+				return uintptr(fd), nil
+			}
+		}
+	}
+
+	// Fall back to the descriptor exposed as a file.  The file is itself a
+	// duplicate, but will close its descriptor when it is collected, so it
+	// is duplicated again and closed.
+	if f, ok := l.Listener.(interface {
+		File() (*os.File, error)
+	}); ok {
+		file, err := f.File()
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		fd, err := syscall.Dup(int(file.Fd()))
+		if err != nil {
+			return 0, err
+		}
+		return uintptr(fd), nil
+	}
+	return 0, errors.New("listener does not expose a file descriptor")
+}
+
 // Close implements the Close() method of the net.Listener interface.
 func (l *listener) Close() error {
 	err := l.Listener.Close()
-	go l.manager.unmanage(l)
+	l.closeOnce.Do(func() {
+		l.manager.spawn(func() {
+			l.manager.unmanage(l)
+		})
+	})
 	return err
 }
 
+// newHTTPServer returns the http.Server used to serve the listener's
+// connections.
+func (l *listener) newHTTPServer(server *Server) *http.Server {
+	maxHeaderBytes := server.MaxHeaderBytes
+	if maxHeaderBytes <= 0 {
+		maxHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+	httpServer := &http.Server{
+		Handler:        server,
+		HTTP2:          server.http2Config(),
+		ReadTimeout:    server.ReadTimeout,
+		WriteTimeout:   server.WriteTimeout,
+		IdleTimeout:    server.IdleTimeout,
+		MaxHeaderBytes: maxHeaderBytes,
+		ConnState:      l.manager.connState(server.ConnState),
+		ErrorLog:       server.errorLog(),
+	}
+	if server.h2cEnabled() {
+		httpServer.Protocols = new(http.Protocols)
+		httpServer.Protocols.SetHTTP1(true)
+		httpServer.Protocols.SetHTTP2(true)
+		httpServer.Protocols.SetUnencryptedHTTP2(true)
+		httpServer.Handler = h2cUpgradeHandler(httpServer)
+	}
+	if configure := server.httpServerConfig(); configure != nil {
+		configure(httpServer)
+	}
+
+	// Contexts provided by the configuration are extended, rather than
+	// replaced, as requests must still be traced back to their listener and
+	// connection.
+	baseContext, connContext := httpServer.BaseContext, httpServer.ConnContext
+	httpServer.BaseContext = func(ln net.Listener) context.Context {
+		ctx := server.requestContext()
+		if baseContext != nil {
+			ctx = withCancelFrom(baseContext(ln), ctx)
+		}
+		return context.WithValue(ctx, listenerContextKey{}, l)
+	}
+	httpServer.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		if tlsConn, ok := c.(*tls.Conn); ok {
+			c = tlsConn.NetConn()
+		}
+		return context.WithValue(ctx, connContextKey{}, c)
+	}
+	return httpServer
+}
+
+// withCancelFrom returns a copy of ctx that is also canceled, with the same
+// cause, when from is canceled.
+func withCancelFrom(ctx, from context.Context) context.Context {
+	if from.Done() == nil {
+		return ctx
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	context.AfterFunc(from, func() {
+		cancel(context.Cause(from))
+	})
+	return ctx
+}
+
 // serve begins serving connections.
 func (l *listener) serve(server *Server) {
-	if err := http.Serve(l, server); err != nil {
+	l.stateMutex.RLock()
+	httpServer := l.httpServer
+	l.stateMutex.RUnlock()
+
+	if err := httpServer.Serve(l); err != nil && err != http.ErrServerClosed {
 		if _, requested := err.(*shutdownRequestedError); !requested {
-			// FIXME: Do something useful here.  Just panicing isn't even
-			// remotely useful.
-			panic(fmt.Errorf("Failed to serve connection: %v", err))
+			server.serveError(l.address(), err)
 		}
 	}
 }
 
+// shutdown closes the listener, if it is not already closing.  Keep-alives are
+// disabled, so connections that are idle are closed, as are active connections
+// once their current request has finished.
+func (l *listener) shutdown() {
+	l.stateMutex.Lock()
+	if l.state&stateClosing == 0 {
+		l.state |= stateClosing
+		close(l.closed)
+		l.Close()
+		if httpServer := l.httpServer; httpServer != nil {
+			// Responses to requests that are in flight tell the client to
+			// close the connection, rather than waiting to be reaped.
+			httpServer.SetKeepAlivesEnabled(false)
+			l.manager.spawn(func() {
+				httpServer.Shutdown(context.Background())
+			})
+		}
+	}
+	l.stateMutex.Unlock()
+}
+
+// stopAccepting closes the listener, if it is not already closing, without
+// shutting down its connections.
+func (l *listener) stopAccepting() bool {
+	l.stateMutex.Lock()
+	defer l.stateMutex.Unlock()
+
+	if l.state&(stateClosing|stateStopped) != 0 {
+		return false
+	}
+	l.state |= stateStopped
+	l.Close()
+	return true
+}
+
+// beginRequest records that the listener is serving a new request.
+func (l *listener) beginRequest() {
+	l.requestsMutex.Lock()
+	l.requests++
+	l.requestsMutex.Unlock()
+}
+
+// endRequest records that the listener has finished serving a request.
+func (l *listener) endRequest() {
+	atomic.AddInt64(&l.servedRequests, 1)
+	l.releaseRequest()
+}
+
+// releaseRequest records that a request, or a hijacked connection, no longer
+// needs to be waited for.
+func (l *listener) releaseRequest() {
+	l.requestsMutex.Lock()
+	l.requests--
+	if l.requests == 0 && l.drained != nil {
+		close(l.drained)
+		l.drained = nil
+	}
+	l.requestsMutex.Unlock()
+}
+
+// waitUntil blocks until all requests being served by the listener have
+// finished, or until the provided channel is closed.  It returns true if all
+// requests have finished.
+func (l *listener) waitUntil(cancel <-chan struct{}) bool {
+	l.requestsMutex.Lock()
+	if l.requests == 0 {
+		l.requestsMutex.Unlock()
+		return true
+	}
+	if l.drained == nil {
+		l.drained = make(chan struct{})
+	}
+	drained := l.drained
+	l.requestsMutex.Unlock()
+
+	select {
+	case <-drained:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// listenerContextKey is the context key used to store the listener that
+// accepted the connection a request was received on.
+type listenerContextKey struct{}
+
+// connContextKey is the context key used to store the connection a request
+// was received on.
+type connContextKey struct{}
+
+// connListener is a listener that accepts a single connection, which has
+// already been accepted elsewhere.
+type connListener struct {
+	conn      net.Conn
+	accepted  chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	doneOnce  sync.Once
+	closed    chan struct{}
+}
+
+// newConnListener returns a listener that accepts c.
+func newConnListener(c net.Conn) *connListener {
+	return &connListener{
+		conn:     c,
+		accepted: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Accept implements the Accept() method of the net.Listener interface.  The
+// connection is returned by the first call, and later calls block until the
+// listener is closed.
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case l.accepted <- struct{}{}:
+		return &connListenerConn{Conn: l.conn, listener: l}, nil
+	default:
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+// Close implements the Close() method of the net.Listener interface.
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// Addr implements the Addr() method of the net.Listener interface.
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// connListenerConn is the connection accepted by a connListener.
+type connListenerConn struct {
+	net.Conn
+	listener *connListener
+}
+
+// Close implements the Close() method of the net.Conn interface.
+func (c *connListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.listener.doneOnce.Do(func() {
+		close(c.listener.done)
+	})
+	return err
+}
+
+// conn is an implementation of the net.Conn interface.
+type conn struct {
+	net.Conn
+	manager   *listeners
+	listener  *listener
+	limit     chan struct{}
+	slots     chan struct{}
+	closeOnce sync.Once
+	// queue, if set, is where capacity must be reserved before the
+	// connection is used.  queueMutex guards slots while the connection is
+	// waiting, and dequeued is closed once the connection is closed.
+	queue      chan struct{}
+	queueOnce  sync.Once
+	queueErr   error
+	queueMutex sync.Mutex
+	dequeued   chan struct{}
+	// queued is accessed atomically, and is set while the connection counts
+	// against the server's MaxQueuedConnections.
+	queued int32
+	// certificate is the certificate presented to the client, if the
+	// connection uses TLS.  It is set during the handshake, and must not be
+	// read until the handshake has completed.
+	certificate *tls.Certificate
+	// protocolRecorded is accessed atomically, and is set once the
+	// protocol negotiated on the connection has been counted.
+	protocolRecorded int32
+	// hijacked is accessed atomically, and is set once the connection has
+	// been hijacked from the http.Server.
+	hijacked int32
+	// readLimiter and writeLimiter throttle the connection, and are nil if
+	// it is not being throttled.
+	readLimiter  *rate.Limiter
+	writeLimiter *rate.Limiter
+}
+
+// Close implements the Close() method of the net.Conn interface.
+func (c *conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if atomic.LoadInt32(&c.hijacked) == 1 {
+			c.listener.releaseRequest()
+		}
+		c.manager.untrackConn(c)
+		releaseConn(c.limit)
+		c.manager.leaveQueue(c)
+		c.queueMutex.Lock()
+		if c.dequeued != nil {
+			close(c.dequeued)
+		}
+		releaseConn(c.slots)
+		c.queueMutex.Unlock()
+	})
+	return err
+}
+
+// Read implements the Read() method of the net.Conn interface.  A queued
+// connection waits for capacity before its first read.
+func (c *conn) Read(b []byte) (int, error) {
+	if err := c.waitForCapacity(); err != nil {
+		return 0, err
+	}
+	return c.readThrottled(b)
+}
+
+// Write implements the Write() method of the net.Conn interface.  A queued
+// connection waits for capacity before its first write.
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.waitForCapacity(); err != nil {
+		return 0, err
+	}
+	return c.writeThrottled(b)
+}
+
+// waitForCapacity waits for a queued connection to reserve capacity, up to the
+// server's ConnectionQueueTimeout.  Connections that time out, or whose
+// listener is shut down while they wait, are closed and an error is returned.
+func (c *conn) waitForCapacity() error {
+	if c.queue == nil {
+		return nil
+	}
+	c.queueOnce.Do(func() {
+		defer c.manager.leaveQueue(c)
+		timer := time.NewTimer(c.manager.server.ConnectionQueueTimeout)
+		defer timer.Stop()
+		select {
+		case c.queue <- struct{}{}:
+			c.queueMutex.Lock()
+			select {
+			case <-c.dequeued:
+				releaseConn(c.queue)
+			default:
+				c.slots = c.queue
+			}
+			c.queueMutex.Unlock()
+		case <-timer.C:
+			c.queueErr = errQueueTimeout
+			c.manager.reject(c, RejectedQueueTimeout)
+		case <-c.listener.closed:
+			c.queueErr = errShutdownRequested
+			c.Close()
+		case <-c.dequeued:
+			c.queueErr = net.ErrClosed
+		}
+	})
+	return c.queueErr
+}
+
 // listeners is a collection of managed listeners.
 type listeners struct {
+	// These are accessed atomically, and must be 64-bit aligned.
+	activeRequests int64
+	acceptedConns  int64
+	servedRequests int64
+	goroutines     int64
+	connRateLimit  int64
+	queuedConns    int64
+	rejections     [numRejectionReasons]int64
+	warned         int32
+
 	sync.RWMutex
+	// The WaitGroup counts managed listeners, active requests, and open
+	// connections, so that waiting on it waits for all of them to finish.
 	sync.WaitGroup
 	listeners []*listener
+	server    *Server
+	connSlots chan struct{}
+	maxConns  int
+
+	connsMutex sync.Mutex
+	conns      map[*conn]struct{}
+
+	protocolsMutex sync.Mutex
+	protocols      map[string]int64
+
+	// stopped holds the listeners that have stopped accepting connections,
+	// but whose connections have not been shut down.  It is guarded by
+	// stoppedMutex.
+	stoppedMutex sync.Mutex
+	stopped      []*listener
+
+	// dependencies maps listener addresses to the addresses of the listeners
+	// they depend on.  It is guarded by the embedded RWMutex.
+	dependencies map[string][]string
+	// proxyProtocol holds the addresses of listeners whose connections begin
+	// with a PROXY protocol header.  It is guarded by the embedded RWMutex.
+	proxyProtocol map[string]bool
+	// proxyBypassNets maps listener addresses to the networks whose
+	// connections may omit the PROXY protocol header.  It is guarded by the
+	// embedded RWMutex.
+	proxyBypassNets map[string][]*net.IPNet
+	// allowedNets maps listener addresses to the networks that they accept
+	// connections from.  It is guarded by the embedded RWMutex.
+	allowedNets map[string][]*net.IPNet
 }
 
-// new creates a new listener.
-func (l *listeners) new(addr string) error {
-	newListener, err := net.Listen("tcp", addr)
+// unixPrefix is the prefix of addresses that refer to Unix domain sockets.
+const unixPrefix = "unix:"
+
+// new creates a new listener.  Addresses beginning with "unix:" create a Unix
+// domain socket listener on the remainder of the address.
+func (l *listeners) new(addr string) (*listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, unixPrefix) {
+		network, addr = "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	listen := l.server.ListenFunc
+	if l.server.Transparent && network == "tcp" {
+		listen = ListenTransparent
+	} else if listen == nil {
+		listen = net.Listen
+	}
+	newListener, err := listen(network, addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	l.manage(newListener)
-	return nil
+	return l.manage(newListener), nil
+}
+
+// listening returns true if a listener that is not closing is managed for
+// addr.
+func (l *listeners) listening(addr string) bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, listener := range l.listeners {
+		if listener.address() == addr && !listener.hasState(stateClosing) {
+			return true
+		}
+	}
+	return false
 }
 
-// reuse creates a new listener using the provided file descriptor.
-func (l *listeners) reuse(fd uintptr, addr string) error {
-	newListener, err := net.FileListener(os.NewFile(fd, "tcp:"+addr+"->"))
+// reuse creates a new listener using the provided file descriptor, which is
+// closed once it is no longer needed.
+func (l *listeners) reuse(fd uintptr, addr string) (*listener, error) {
+	// The listener is created from a duplicate of the descriptor.
+	file := os.NewFile(fd, addr)
+	newListener, err := net.FileListener(file)
+	file.Close()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// Listeners created from a file do not remove their socket file when
+	// closed, but a reused listener is now responsible for it.
+	if unixListener, ok := newListener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(true)
 	}
 
-	var reused bool
+	// A listener that is already managed for the address is replaced in
+	// place, with the new listener taking over its place in the wait group.
+	var reused, replaced *listener
+	max := l.maxConnsPerListener()
 	l.Lock()
 	for i, li := range l.listeners {
-		if li.Addr().String() == addr {
-			l.listeners[i] = &listener{
-				Listener:  newListener,
-				manager:   l,
-				state:     stateListening,
-				tlsConfig: &tls.Config{},
-			}
-			reused = true
+		if li.address() == addr {
+			reused = l.wrap(newListener, max)
+			replaced, l.listeners[i] = li, reused
+			break
 		}
 	}
 	l.Unlock()
 
-	if !reused {
-		l.manage(newListener.(*net.TCPListener))
+	if reused == nil {
+		return l.manage(newListener), nil
 	}
-	return nil
+
+	// The replaced listener shares its socket with the new listener, so the
+	// socket file must outlive it.
+	if unixListener, ok := replaced.Listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+	replaced.shutdown()
+	return reused, nil
 }
 
 // manage keeps track of the provided listener.
-func (l *listeners) manage(li net.Listener) {
+func (l *listeners) manage(li net.Listener) *listener {
+	managed := l.wrap(li, l.maxConnsPerListener())
+	l.Lock()
+	l.listeners = append(l.listeners, managed)
+	l.Add(1)
+	l.Unlock()
+	return managed
+}
+
+// serveConn serves the provided connection, which has already been accepted,
+// using the provided TLS configuration, and blocks until it is closed.  The
+// connection is served by a listener of its own, so that it is accounted for
+// and shut down like any other.
+func (l *listeners) serveConn(server *Server, c net.Conn, config *tls.Config) {
+	connListener := newConnListener(c)
+	managed := l.wrap(connListener, l.maxConnsPerListener())
+	managed.configureTLS(config)
+	// The listener is serving before it is managed, so that it is not
+	// served again by Serve.
+	managed.state |= stateServing
+	managed.httpServer = managed.newHTTPServer(server)
 	l.Lock()
-	l.listeners = append(l.listeners, &listener{
+	l.listeners = append(l.listeners, managed)
+	l.Add(1)
+	l.Unlock()
+
+	served := make(chan struct{})
+	l.spawn(func() {
+		defer close(served)
+		managed.serve(server)
+	})
+	select {
+	case <-connListener.done:
+	case <-served:
+		// The listener may have been shut down before the connection was
+		// handed to the http.Server, in which case nothing else will close
+		// it.
+		select {
+		case connListener.accepted <- struct{}{}:
+			c.Close()
+		case <-connListener.done:
+		}
+	}
+	managed.shutdown()
+}
+
+// wrap returns a new listener for the provided net.Listener, limited to max
+// active connections.
+func (l *listeners) wrap(li net.Listener, max int) *listener {
+	wrapped := &listener{
 		Listener:  li,
 		manager:   l,
 		state:     stateListening,
 		tlsConfig: &tls.Config{},
-	})
-	l.Add(1)
-	l.Unlock()
+		closed:    make(chan struct{}),
+	}
+	wrapped.setConnLimit(max)
+	return wrapped
 }
 
 // unmanage stops keeping track of the provided listener.
 func (l *listeners) unmanage(listener *listener) {
+	var found bool
 	l.Lock()
 	for i, li := range l.listeners {
 		if li == listener {
 			l.listeners[len(l.listeners)-1], l.listeners[i], l.listeners =
 				nil, l.listeners[len(l.listeners)-1], l.listeners[:len(l.listeners)-1]
-			l.Done()
+			found = true
 			break
 		}
 	}
@@ -171,13 +900,27 @@ func (l *listeners) unmanage(listener *listener) {
 		l.listeners = nil
 	}
 	l.Unlock()
+
+	// Only signal that the listener is gone once it has been removed, so
+	// that anything waiting on it sees the result.
+	if found {
+		l.Done()
+	}
 }
 
 // configureTLS sets the TLS configuration for each listener that is not
-// serving connections or closing.
+// serving connections or closing, and that does not have its own TLS
+// configuration.
 func (l *listeners) configureTLS(config *tls.Config) {
 	l.RLock()
 	for _, listener := range l.listeners {
+		listener.tlsMutex.RLock()
+		ownTLS := listener.ownTLS
+		listener.tlsMutex.RUnlock()
+		if ownTLS {
+			continue
+		}
+
 		// Ignore listeners that are serving or closing.
 		listener.stateMutex.RLock()
 		if listener.state&(stateServing|stateClosing) == 0 {
@@ -188,46 +931,618 @@ func (l *listeners) configureTLS(config *tls.Config) {
 	l.RUnlock()
 }
 
+// reloadTLS sets the TLS configuration for each listener that is not closing,
+// and that does not have its own TLS configuration.  Unlike configureTLS, this
+// also applies to listeners that are serving connections, provided that they
+// are already serving TLS connections.  Connections that have already been
+// accepted continue to use the previous configuration.
+func (l *listeners) reloadTLS(config *tls.Config) {
+	l.RLock()
+	for _, listener := range l.listeners {
+		listener.tlsMutex.RLock()
+		ownTLS := listener.ownTLS
+		listener.tlsMutex.RUnlock()
+		if ownTLS {
+			continue
+		}
+
+		// Ignore listeners that are closing, or serving without TLS.
+		listener.stateMutex.RLock()
+		if listener.state&stateClosing == 0 &&
+			(listener.state&stateServing == 0 || listener.tlsConfigured()) {
+			listener.configureTLS(config)
+		}
+		listener.stateMutex.RUnlock()
+	}
+	l.RUnlock()
+}
+
+// serving returns true if any listener is serving connections.
+func (l *listeners) serving() bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, listener := range l.listeners {
+		if listener.hasState(stateServing) {
+			return true
+		}
+	}
+	return false
+}
+
+// servingTLS returns true if any listener without its own TLS configuration is
+// serving TLS connections.
+func (l *listeners) servingTLS() bool {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, listener := range l.listeners {
+		listener.tlsMutex.RLock()
+		ownTLS := listener.ownTLS
+		listener.tlsMutex.RUnlock()
+		if !ownTLS && listener.hasState(stateServing) && !listener.hasState(stateClosing) &&
+			listener.tlsConfigured() {
+			return true
+		}
+	}
+	return false
+}
+
+// spawn runs the provided function in a new goroutine, keeping track of it
+// until it returns.
+func (l *listeners) spawn(fn func()) {
+	atomic.AddInt64(&l.goroutines, 1)
+	l.checkGoroutines()
+	go func() {
+		defer atomic.AddInt64(&l.goroutines, -1)
+		fn()
+	}()
+}
+
+// goroutineCount returns the number of goroutines running on behalf of the
+// server.  This includes one goroutine for each active connection.
+func (l *listeners) goroutineCount() int {
+	return int(atomic.LoadInt64(&l.goroutines)) + l.connCount()
+}
+
+// connCount returns the number of connections being tracked.
+func (l *listeners) connCount() int {
+	l.connsMutex.Lock()
+	defer l.connsMutex.Unlock()
+	return len(l.conns)
+}
+
+// checkGoroutines logs a warning if the number of goroutines running on behalf
+// of the server exceeds the server's GoroutineWarningThreshold.  The warning is
+// only logged once until the number drops back below the threshold.
+func (l *listeners) checkGoroutines() {
+	threshold := l.server.GoroutineWarningThreshold
+	if threshold <= 0 {
+		return
+	}
+	if count := l.goroutineCount(); count <= threshold {
+		atomic.StoreInt32(&l.warned, 0)
+	} else if atomic.CompareAndSwapInt32(&l.warned, 0, 1) {
+		l.server.logf("server: %d goroutines running, exceeding the threshold of %d; this may indicate a leak", count, threshold)
+	}
+}
+
+// trackConn keeps track of the provided connection, accepted by listener, until
+// it is closed.  The limit and slots channels, if any, are drained when the
+// connection is closed.
+func (l *listeners) trackConn(c net.Conn, listener *listener, limit, slots, queue chan struct{}) *conn {
+	tracked := &conn{Conn: c, manager: l, listener: listener, limit: limit, slots: slots}
+	if queue != nil {
+		tracked.queue = queue
+		tracked.dequeued = make(chan struct{})
+		if l.server.MaxQueuedConnections > 0 {
+			tracked.queued = 1
+		}
+	}
+	if bytesPerSec := atomic.LoadInt64(&l.connRateLimit); bytesPerSec > 0 {
+		tracked.readLimiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+		tracked.writeLimiter = rate.NewLimiter(rate.Limit(bytesPerSec), int(bytesPerSec))
+	}
+	atomic.AddInt64(&l.acceptedConns, 1)
+	atomic.AddInt64(&listener.acceptedConns, 1)
+	atomic.AddInt64(&listener.activeConns, 1)
+	l.Add(1)
+	l.connsMutex.Lock()
+	if l.conns == nil {
+		l.conns = make(map[*conn]struct{})
+	}
+	l.conns[tracked] = struct{}{}
+	l.connsMutex.Unlock()
+	l.checkGoroutines()
+	return tracked
+}
+
+// untrackConn stops keeping track of the provided connection.
+func (l *listeners) untrackConn(c *conn) {
+	l.connsMutex.Lock()
+	delete(l.conns, c)
+	l.connsMutex.Unlock()
+	atomic.AddInt64(&c.listener.activeConns, -1)
+	l.Done()
+}
+
+// closeConns forcefully closes all tracked connections, and returns the number
+// of connections that were closed.
+func (l *listeners) closeConns() int {
+	return l.closeListenerConns(nil)
+}
+
+// closeListenerConns forcefully closes the tracked connections that were
+// accepted by the provided listener, or all of them if it is nil, and returns
+// the number of connections that were closed.
+func (l *listeners) closeListenerConns(listener *listener) int {
+	l.connsMutex.Lock()
+	conns := make([]*conn, 0, len(l.conns))
+	for c := range l.conns {
+		if listener == nil || c.listener == listener {
+			conns = append(conns, c)
+		}
+	}
+	l.connsMutex.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// connState returns a ConnState function for a listener's http.Server, which
+// records the protocol negotiated on each TLS connection once it becomes active,
+// and then calls the provided function, if it is set.
+func (l *listeners) connState(fn func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateActive:
+			l.recordProtocol(c)
+		case http.StateHijacked:
+			l.holdHijacked(c)
+		}
+		if fn != nil {
+			fn(c, state)
+		}
+	}
+}
+
+// holdHijacked keeps the provided connection, which has been hijacked from the
+// http.Server by a handler, counted as an active request of its listener until
+// it is closed.  Otherwise, the request would end when the handler returns,
+// and shutting down the listener would not wait for the connection, which the
+// http.Server no longer manages.
+func (l *listeners) holdHijacked(c net.Conn) {
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		c = tlsConn.NetConn()
+	}
+	tracked, ok := c.(*conn)
+	if !ok || !atomic.CompareAndSwapInt32(&tracked.hijacked, 0, 1) {
+		return
+	}
+	tracked.listener.beginRequest()
+}
+
+// recordProtocol counts the protocol negotiated via ALPN on the provided
+// connection, if it is a TLS connection that has not already been counted.
+func (l *listeners) recordProtocol(c net.Conn) {
+	tlsConn, ok := c.(*tls.Conn)
+	if !ok {
+		return
+	}
+	tracked, ok := tlsConn.NetConn().(*conn)
+	if !ok || !atomic.CompareAndSwapInt32(&tracked.protocolRecorded, 0, 1) {
+		return
+	}
+
+	protocol := tlsConn.ConnectionState().NegotiatedProtocol
+	l.protocolsMutex.Lock()
+	if l.protocols == nil {
+		l.protocols = make(map[string]int64)
+	}
+	l.protocols[protocol]++
+	l.protocolsMutex.Unlock()
+}
+
+// configureKeepAlive configures TCP keep-alive probing on the provided
+// connection, if the server has been configured to do so.
+func (l *listeners) configureKeepAlive(c *net.TCPConn) {
+	s := l.server
+	if s.TCPKeepAlivePeriod < 0 {
+		if err := c.SetKeepAlive(false); err != nil {
+			s.logf("server: failed to disable keep-alive for %v: %v", c.RemoteAddr(), err)
+		}
+		return
+	}
+	if s.TCPKeepAlivePeriod == 0 && s.KeepAliveIdle <= 0 && s.KeepAliveInterval <= 0 && s.KeepAliveCount <= 0 {
+		return
+	}
+
+	// Negative values leave the operating system defaults in place.
+	config := net.KeepAliveConfig{Enable: true, Idle: -1, Interval: -1, Count: -1}
+	if s.TCPKeepAlivePeriod > 0 {
+		config.Idle, config.Interval = s.TCPKeepAlivePeriod, s.TCPKeepAlivePeriod
+	}
+	if s.KeepAliveIdle > 0 {
+		config.Idle = s.KeepAliveIdle
+	}
+	if s.KeepAliveInterval > 0 {
+		config.Interval = s.KeepAliveInterval
+	}
+	if s.KeepAliveCount > 0 {
+		config.Count = s.KeepAliveCount
+	}
+	if err := c.SetKeepAliveConfig(config); err != nil {
+		s.logf("server: failed to configure keep-alive for %v: %v", c.RemoteAddr(), err)
+	}
+}
+
+// limitConns limits the number of active connections to max, if no limit has
+// already been set.  A max of zero or less means no limit.
+func (l *listeners) limitConns(max int) {
+	l.Lock()
+	if l.connSlots == nil && max > 0 {
+		l.connSlots = make(chan struct{}, max)
+	}
+	l.Unlock()
+}
+
+// setMaxConnsPerListener limits the number of connections that each listener,
+// current and future, may have active at once.
+func (l *listeners) setMaxConnsPerListener(max int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.maxConns = max
+	for _, listener := range l.listeners {
+		listener.setConnLimit(max)
+	}
+}
+
+// maxConnsPerListener returns the number of connections that each listener may
+// have active at once.
+func (l *listeners) maxConnsPerListener() int {
+	l.RLock()
+	defer l.RUnlock()
+	return l.maxConns
+}
+
+// acquireConn reserves capacity for a new connection, if there is any.  The
+// returned channel must be drained once the connection is closed, and is nil
+// if connections are not being limited.  If capacity could not be reserved,
+// the reason the connection should be rejected is returned.
+func (l *listeners) acquireConn() (chan struct{}, RejectionReason, bool) {
+	l.RLock()
+	slots := l.connSlots
+	l.RUnlock()
+	if slots == nil {
+		return nil, 0, true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return slots, 0, true
+	default:
+		return nil, RejectedMaxConnections, false
+	}
+}
+
+// connQueue returns the channel that a connection which could not reserve
+// capacity should wait on, or nil if such connections are to be rejected.  A
+// connection that is given a channel counts against MaxQueuedConnections until
+// it is passed to leaveQueue.
+func (l *listeners) connQueue() chan struct{} {
+	if l.server.ConnectionQueueTimeout <= 0 {
+		return nil
+	}
+	l.RLock()
+	slots := l.connSlots
+	l.RUnlock()
+	if slots == nil {
+		return nil
+	}
+	if max := int64(l.server.MaxQueuedConnections); max > 0 {
+		if atomic.AddInt64(&l.queuedConns, 1) > max {
+			atomic.AddInt64(&l.queuedConns, -1)
+			return nil
+		}
+	}
+	return slots
+}
+
+// leaveQueue stops the provided connection from counting against
+// MaxQueuedConnections, if it does.
+func (l *listeners) leaveQueue(c *conn) {
+	if atomic.CompareAndSwapInt32(&c.queued, 1, 0) {
+		atomic.AddInt64(&l.queuedConns, -1)
+	}
+}
+
+// reject closes a connection that is being rejected for the provided reason,
+// counting the rejection and notifying OnConnectionRejected.
+func (l *listeners) reject(c net.Conn, reason RejectionReason) {
+	remoteAddr := acceptedRemoteAddr(c).String()
+	c.Close()
+	atomic.AddInt64(&l.rejections[reason], 1)
+	if l.server.OnConnectionRejected != nil {
+		l.server.OnConnectionRejected(remoteAddr, reason)
+	}
+}
+
 // serve begins serving connections for each listener that is not already
-// serving connections or closing.
-func (l *listeners) serve(server *Server) {
+// serving connections or closing.  Listeners that are unable to begin serving
+// connections are closed, and their errors are returned.
+func (l *listeners) serve(server *Server) error {
+	errs := ServeErrors{}
+	var failed []*listener
 	l.RLock()
 	for _, listener := range l.listeners {
 		// Ignore listeners that are serving or closing.
 		listener.stateMutex.Lock()
 		if listener.state&(stateServing|stateClosing) == 0 {
-			listener.state |= stateServing
-			go listener.serve(server)
+			if err := listener.check(); err != nil {
+				errs[listener.address()] = err
+				listener.state |= stateClosing
+				failed = append(failed, listener)
+			} else {
+				listener.state |= stateServing
+				listener.httpServer = listener.newHTTPServer(server)
+				listener := listener
+				l.spawn(func() {
+					listener.serve(server)
+				})
+			}
 		}
 		listener.stateMutex.Unlock()
 	}
 	l.RUnlock()
+
+	for _, listener := range failed {
+		listener.Close()
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 // shutdown requests that each listener that is not already closing be shut
 // down.  Is graceful is true, this function blocks until all listeners have
-// been shut down.
+// been shut down, and all of their connections closed.
 func (l *listeners) shutdown(graceful bool) {
+	if graceful {
+		l.closeInOrder(nil)
+		l.Wait()
+	} else {
+		l.close()
+		// Handlers that are still running notice that their connection
+		// was closed the next time they read from or write to it.
+		l.closeConns()
+	}
+}
+
+// stopDetached shuts down each listener that has been detached.  If graceful,
+// it blocks until their active requests have finished, otherwise their
+// connections are forcefully closed.
+func (l *listeners) stopDetached(graceful bool) {
+	var detached []*listener
 	l.RLock()
 	for _, listener := range l.listeners {
-		// Ignore listeners that are closing.
-		listener.stateMutex.Lock()
-		if listener.state&stateClosing == 0 {
-			listener.state |= stateClosing
-			listener.Close()
+		if listener.hasState(stateDetached) {
+			detached = append(detached, listener)
 		}
-		listener.stateMutex.Unlock()
 	}
 	l.RUnlock()
-	if graceful {
+
+	for _, listener := range detached {
+		listener.shutdown()
+	}
+	for _, listener := range detached {
+		if graceful {
+			listener.waitUntil(nil)
+		} else {
+			l.closeListenerConns(listener)
+		}
+	}
+}
+
+// shutdownWithTimeout requests that each listener that is not already closing
+// be shut down, and blocks until all listeners have been shut down or the
+// timeout expires.  Once the timeout expires, all remaining connections are
+// forcefully closed.  It returns the number of connections that were
+// forcefully closed, and whether or not the timeout expired.
+func (l *listeners) shutdownWithTimeout(timeout time.Duration) (int, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	l.closeInOrder(ctx.Done())
+
+	var abandoned int
+	var expired bool
+	if !l.waitUntil(ctx.Done()) {
+		abandoned, expired = l.closeConns(), true
+	}
+	return abandoned, expired
+}
+
+// shutdownContext requests that each listener that is not already closing be
+// shut down, and blocks until all listeners have been shut down or the context
+// is done.  If the context is done first, its error is returned.
+func (l *listeners) shutdownContext(ctx context.Context) error {
+	l.closeInOrder(ctx.Done())
+	if !l.waitUntil(ctx.Done()) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// waitUntil blocks until all listeners have been shut down, or until the
+// provided channel is closed.  It returns true if all listeners have been shut
+// down.
+func (l *listeners) waitUntil(cancel <-chan struct{}) bool {
+	drained := make(chan struct{})
+	l.spawn(func() {
 		l.Wait()
+		close(drained)
+	})
+
+	select {
+	case <-drained:
+		return true
+	case <-cancel:
+		return false
 	}
+}
 
-	// FIXME: Somewhat rarely, connections aren't gracefully shut down.  In
-	// curl, this manifests as error 52 ("Empty reply from server").  One way
-	// to work around this is to add a minor delay here.  A proper fix should
-	// be investigated and implemented instead.
-	time.Sleep(100 * time.Millisecond)
+// close closes each listener that is not already closing.
+func (l *listeners) close() {
+	l.shutdownStopped()
+	l.RLock()
+	for _, listener := range l.listeners {
+		listener.shutdown()
+	}
+	l.RUnlock()
+}
+
+// stopAccepting closes every listener that is not already closing, without
+// shutting down their connections, which keep being served.
+func (l *listeners) stopAccepting() {
+	l.RLock()
+	listeners := append([]*listener(nil), l.listeners...)
+	l.RUnlock()
+
+	for _, listener := range listeners {
+		if listener.stopAccepting() {
+			l.stoppedMutex.Lock()
+			l.stopped = append(l.stopped, listener)
+			l.stoppedMutex.Unlock()
+		}
+	}
+}
+
+// shutdownStopped shuts down the connections of the listeners that have
+// stopped accepting connections.
+func (l *listeners) shutdownStopped() {
+	l.stoppedMutex.Lock()
+	stopped := l.stopped
+	l.stopped = nil
+	l.stoppedMutex.Unlock()
+
+	for _, listener := range stopped {
+		listener.shutdown()
+	}
+}
+
+// closeInOrder closes each listener that is not already closing, respecting
+// the declared dependencies between listeners.  Each listener is closed, and
+// its active requests allowed to finish, before the listeners it depends on
+// are closed.  If the provided channel is closed before that happens, all
+// remaining listeners are closed immediately and false is returned.
+func (l *listeners) closeInOrder(cancel <-chan struct{}) bool {
+	l.shutdownStopped()
+	stages := l.shutdownStages()
+	for i, stage := range stages {
+		for _, listener := range stage {
+			listener.shutdown()
+		}
+		if i == len(stages)-1 {
+			break
+		}
+		for _, listener := range stage {
+			if !listener.waitUntil(cancel) {
+				l.close()
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// shutdownStages groups the listeners that are not closing into the order in
+// which they should be shut down, such that no listener is shut down before
+// the listeners that depend on it.
+func (l *listeners) shutdownStages() [][]*listener {
+	l.RLock()
+	defer l.RUnlock()
+
+	var remaining []*listener
+	for _, listener := range l.listeners {
+		if listener.hasState(stateClosing) {
+			continue
+		}
+		remaining = append(remaining, listener)
+	}
+
+	var stages [][]*listener
+	for len(remaining) > 0 {
+		required := make(map[string]bool)
+		for _, listener := range remaining {
+			for _, dep := range l.dependencies[listener.address()] {
+				required[dep] = true
+			}
+		}
+
+		var stage, rest []*listener
+		for _, listener := range remaining {
+			if required[listener.address()] {
+				rest = append(rest, listener)
+			} else {
+				stage = append(stage, listener)
+			}
+		}
+		if len(stage) == 0 {
+			// Cycles are rejected when dependencies are declared, but
+			// never loop forever.
+			stage, rest = rest, nil
+		}
+		stages = append(stages, stage)
+		remaining = rest
+	}
+	return stages
+}
+
+// addDependencies declares that the listener for addr depends on the
+// listeners for deps.  An error is returned if doing so would create a cycle.
+func (l *listeners) addDependencies(addr string, deps ...string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.dependencies == nil {
+		l.dependencies = make(map[string][]string)
+	}
+	previous := l.dependencies[addr]
+	l.dependencies[addr] = append(append([]string(nil), previous...), deps...)
+
+	// Ensure that addr can not be reached by following its dependencies.
+	visited := make(map[string]bool)
+	pending := append([]string(nil), l.dependencies[addr]...)
+	for len(pending) > 0 {
+		dep := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if dep == addr {
+			l.dependencies[addr] = previous
+			return fmt.Errorf("shutdown dependency cycle involving %v", addr)
+		}
+		if !visited[dep] {
+			visited[dep] = true
+			pending = append(pending, l.dependencies[dep]...)
+		}
+	}
+	return nil
+}
+
+// addrs returns the addresses of all listeners that are not closing.
+func (l *listeners) addrs() []net.Addr {
+	l.RLock()
+	defer l.RUnlock()
+
+	addrs := make([]net.Addr, 0, len(l.listeners))
+	for _, listener := range l.listeners {
+		if !listener.hasState(stateClosing) {
+			addrs = append(addrs, listener.Addr())
+		}
+	}
+	return addrs
 }
 
 // detach returns an address to underlying file descriptor mapping for all
@@ -236,12 +1551,22 @@ func (l *listeners) detach() DetachedListeners {
 	l.RLock()
 	listeners := make(DetachedListeners)
 	for _, listener := range l.listeners {
-		// Ignore listeners that are closing.
+		// Ignore listeners that are closing, and those serving a single
+		// connection, which can not be detached.
 		listener.stateMutex.Lock()
-		if listener.state&stateClosing == 0 {
-			fd := reflect.ValueOf(listener.Listener).Elem().FieldByName("fd").Elem()
-			listeners[listener.Addr().String()] = uintptr(fd.FieldByName("sysfd").Int())
-			listener.state |= stateDetached
+		_, served := listener.Listener.(*connListener)
+		if listener.state&stateClosing == 0 && !served {
+			if fd, err := listener.fd(); err == nil {
+				listeners[listener.address()] = fd
+				listener.state |= stateDetached
+				// The socket file must outlive this listener, so that it can
+				// be reused.
+				if unixListener, ok := listener.Listener.(*net.UnixListener); ok {
+					unixListener.SetUnlinkOnClose(false)
+				}
+			} else {
+				l.server.logf("server: failed to detach %v: %v", listener.Addr(), err)
+			}
 		}
 		listener.stateMutex.Unlock()
 	}
@@ -254,6 +1579,25 @@ func (l *listeners) detach() DetachedListeners {
 // have been detached.
 type DetachedListeners map[string]uintptr
 
+// ServeErrors is an address to error mapping of listeners that were unable to
+// begin serving connections.
+type ServeErrors map[string]error
+
+// Error implements the Error() method of the error interface.
+func (e ServeErrors) Error() string {
+	addrs := make([]string, 0, len(e))
+	for addr := range e {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	msgs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		msgs[i] = addr + ": " + e[addr].Error()
+	}
+	return "failed to serve: " + strings.Join(msgs, "; ")
+}
+
 // shutdownRequestedError is an implementation of the error interface.  It is
 // used to indicate that the shutdown of a listener was requested.
 type shutdownRequestedError struct{}
@@ -264,3 +1608,7 @@ func (e *shutdownRequestedError) Error() string { return "shutdown requested" }
 // errShutdownRequested is the error returned by Accept when it is responding
 // to a requested shutdown.
 var errShutdownRequested = &shutdownRequestedError{}
+
+// errQueueTimeout is the error returned when a queued connection is used after
+// it was rejected for waiting too long for capacity.
+var errQueueTimeout = errors.New("server: timed out waiting for connection capacity")
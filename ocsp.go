@@ -0,0 +1,177 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspRequestTimeout is how long a single request to an OCSP responder is
+// allowed to take.
+const ocspRequestTimeout = 10 * time.Second
+
+// SetOCSPResponse staples the provided DER encoded OCSP response to the
+// certificate at certIndex, in the order certificates were added.  The
+// response is sent to every client that is given the certificate from then on,
+// including those of listeners that are already serving TLS connections.
+func (s *Server) SetOCSPResponse(certIndex int, ocspResponse []byte) error {
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	if s.TLS == nil || certIndex < 0 || certIndex >= len(s.TLS.Certificates) {
+		return fmt.Errorf("server: no certificate at index %d", certIndex)
+	}
+	s.stapleOCSP(certIndex, ocspResponse)
+	return nil
+}
+
+// stapleOCSP staples the provided OCSP response to the certificate at
+// certIndex, and reloads the listeners.  The certificates are copied rather
+// than modified, as they may be in use by listeners.  The caller must hold
+// the TLS mutex.
+func (s *Server) stapleOCSP(certIndex int, ocspResponse []byte) {
+	certs := make([]tls.Certificate, len(s.TLS.Certificates))
+	copy(certs, s.TLS.Certificates)
+	certs[certIndex].OCSPStaple = ocspResponse
+	s.TLS.Certificates = certs
+	s.TLS.BuildNameToCertificate()
+	s.listeners.reloadTLS(s.TLS)
+}
+
+// RefreshOCSPResponses fetches a new OCSP response, on the provided interval,
+// for each certificate that names an OCSP responder and includes its issuer in
+// its chain, and staples it to the certificate.  Responses are fetched once
+// immediately.  Failures are logged, and the previous response, if any, is
+// kept.  Refreshing stops when the server is shut down, or when this is called
+// again; an interval of zero only stops it.
+func (s *Server) RefreshOCSPResponses(interval time.Duration) {
+	s.ocspMutex.Lock()
+	defer s.ocspMutex.Unlock()
+
+	if s.stopOCSP != nil {
+		s.stopOCSP()
+		s.stopOCSP = nil
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopOCSP = cancel
+	s.listeners.spawn(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.refreshOCSP(ctx)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// stopRefreshingOCSP stops refreshing OCSP responses, if it was started.
+func (s *Server) stopRefreshingOCSP() {
+	s.ocspMutex.Lock()
+	defer s.ocspMutex.Unlock()
+
+	if s.stopOCSP != nil {
+		s.stopOCSP()
+		s.stopOCSP = nil
+	}
+}
+
+// refreshOCSP fetches and staples a new OCSP response for each certificate
+// that supports it.
+func (s *Server) refreshOCSP(ctx context.Context) {
+	s.tlsMutex.RLock()
+	var certs []tls.Certificate
+	if s.TLS != nil {
+		certs = s.TLS.Certificates
+	}
+	s.tlsMutex.RUnlock()
+
+	for i, cert := range certs {
+		if len(cert.Certificate) < 2 {
+			continue
+		}
+		leaf, err := leafCertificate(cert)
+		if err != nil || len(leaf.OCSPServer) == 0 {
+			continue
+		}
+		issuer, err := x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			s.logf("server: failed to parse the issuer of %v: %v", leaf.Subject.CommonName, err)
+			continue
+		}
+
+		ocspResponse, err := fetchOCSPResponse(ctx, leaf, issuer)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logf("server: failed to fetch OCSP response for %v: %v", leaf.Subject.CommonName, err)
+			}
+			continue
+		}
+
+		// The certificates may have changed while the response was being
+		// fetched, so only staple it if the certificate is still in place.
+		s.tlsMutex.Lock()
+		if i < len(s.TLS.Certificates) &&
+			bytes.Equal(s.TLS.Certificates[i].Certificate[0], cert.Certificate[0]) {
+			s.stapleOCSP(i, ocspResponse)
+		}
+		s.tlsMutex.Unlock()
+	}
+}
+
+// fetchOCSPResponse requests the status of leaf from its OCSP responder, and
+// returns the DER encoded response once it has been verified.
+func fetchOCSPResponse(ctx context.Context, leaf, issuer *x509.Certificate) ([]byte, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ocspRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", leaf.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder %v responded with status %v", leaf.OCSPServer[0], resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Status == ocsp.Unknown {
+		return nil, errors.New("responder does not know the certificate's status")
+	}
+	return body, nil
+}
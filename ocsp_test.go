@@ -0,0 +1,163 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestSetOCSPResponse(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.SetOCSPResponse(0, []byte("staple")); err == nil {
+		t.Error("Expected an error when stapling to a missing certificate.")
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the staple is sent by a listener that is already serving.
+	if err = server.SetOCSPResponse(0, []byte("staple")); err != nil {
+		t.Fatalf("Expected no error when stapling, received '%v'.", err)
+	}
+	if staple := ocspStaple(t, addrs[0], addrToServerName[addrs[0]], nil); string(staple) != "staple" {
+		t.Errorf("Expected OCSP response 'staple', received '%v'.", string(staple))
+	}
+}
+
+func TestRefreshOCSPResponses(t *testing.T) {
+	// Issue a certificate that names a test OCSP responder.
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected no error generating a key, received '%v'.", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OCSP Testing CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Expected no error creating the CA certificate, received '%v'.", err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	responses := make(chan []byte, 10)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		responses <- resp
+		w.Write(resp)
+	}))
+	defer responder.Close()
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Expected no error generating a key, received '%v'.", err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ocsp.localhost"},
+		DNSNames:     []string{"ocsp.localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{responder.URL},
+	}, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Expected no error creating the certificate, received '%v'.", err)
+	}
+
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.addTLSCert(tls.Certificate{
+		Certificate: [][]byte{leafDER, caDER},
+		PrivateKey:  leafKey,
+	}); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+	server.RefreshOCSPResponses(time.Hour)
+
+	// Ensure that the fetched response is stapled.
+	var fetched []byte
+	select {
+	case fetched = <-responses:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the OCSP responder to be queried.")
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for i := 0; i < 100; i++ {
+		if bytes.Equal(ocspStaple(t, addrs[0], "ocsp.localhost", roots), fetched) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the fetched OCSP response to be stapled.")
+}
+
+// ocspStaple performs a TLS handshake, over a new connection, with the given
+// server, and returns the OCSP response it stapled.  If roots is nil, the
+// testing CA is trusted.
+func ocspStaple(t *testing.T, addr, serverName string, roots *x509.CertPool) []byte {
+	if roots == nil {
+		roots = httpTransport.TLSClientConfig.RootCAs
+	}
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addr, err)
+	}
+	defer c.Close()
+	return c.ConnectionState().OCSPResponse
+}
@@ -0,0 +1,43 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// DropPrivileges changes the user and group of the process to uid and gid,
+// and removes its supplementary groups, so that a server started as root to
+// listen on privileged ports, such as 80 and 443, does not serve connections
+// as root.  It must be called after Listen and before Serve, as an error is
+// returned if any listener is already serving connections.
+//
+// The user and group are process wide; they apply to every server in the
+// process, and every goroutine, not only those of this server.  Before Go
+// 1.16, changing them on Linux only affected the calling thread, so Go 1.16 or
+// later is required there.  Files, such as certificates, that are read after
+// the drop must be readable by the new user.  Privileges can not be regained,
+// but a process started by Restart inherits its listeners, and calling this
+// again in that process, as the same user and group, does nothing.
+func (s *Server) DropPrivileges(uid, gid int) error {
+	if s.listeners.serving() {
+		return errors.New("server: privileges must be dropped before serving")
+	}
+	if syscall.Getuid() == uid && syscall.Geteuid() == uid && syscall.Getgid() == gid && syscall.Getegid() == gid {
+		return nil
+	}
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("server: failed to remove supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("server: failed to set group to %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("server: failed to set user to %d: %v", uid, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// dropPrivilegesEnv is set when TestDropPrivileges runs in a child process,
+// so that dropping privileges does not affect the remaining tests.
+const dropPrivilegesEnv = "GO_SERVER_TEST_DROP_PRIVILEGES"
+
+// nobody is the uid and gid that privileges are dropped to.
+const nobody = 65534
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Skipping, as dropping privileges requires running as root.")
+	}
+	if os.Getenv(dropPrivilegesEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$", "-test.v")
+		cmd.Env = append(os.Environ(), dropPrivilegesEnv+"=1")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Expected no error from the child process, received '%v':\n%s", err, output)
+		}
+		return
+	}
+
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err := server.DropPrivileges(nobody, nobody); err != nil {
+		t.Fatalf("Expected no error when dropping privileges, received '%v'.", err)
+	}
+	if uid, gid := os.Geteuid(), os.Getegid(); uid != nobody || gid != nobody {
+		t.Fatalf("Expected to run as %v:%v, running as '%v:%v'.", nobody, nobody, uid, gid)
+	}
+	server.Serve()
+
+	// Ensure that the server still serves, and that privileges can no longer
+	// be changed once it does.
+	if err := rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+	if err := server.DropPrivileges(0, 0); err == nil {
+		t.Error("Expected an error when dropping privileges while serving.")
+	}
+}
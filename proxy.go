@@ -0,0 +1,316 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a client has to send its PROXY protocol
+// header once its connection has been accepted.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV1MaxLength is the maximum length of a version 1 PROXY protocol header,
+// including its trailing CRLF.
+const proxyV1MaxLength = 107
+
+// proxyV2Signature begins every version 2 PROXY protocol header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// These are the commands and address families of version 2 PROXY protocol
+// headers that are understood.
+const (
+	proxyV2Local byte = 0x0
+	proxyV2Proxy byte = 0x1
+	proxyV2TCP4  byte = 0x11
+	proxyV2TCP6  byte = 0x21
+)
+
+// errInvalidProxyHeader is returned when reading from a connection whose PROXY
+// protocol header could not be parsed.
+var errInvalidProxyHeader = errors.New("server: invalid PROXY protocol header")
+
+// EnableProxyProtocol requires connections accepted by the listener for addr
+// to begin with a PROXY protocol header, as sent by load balancers such as
+// HAProxy and AWS NLB.  Both version 1 and version 2 headers are supported.
+// The addresses in the header become the connection's remote and local
+// addresses, so that r.RemoteAddr is the address of the original client.
+// Connections without a valid header are closed.  The requirement is kept by
+// address, so it covers connections accepted from now on by the listener for
+// addr, whether it already exists or is created later.
+func (s *Server) EnableProxyProtocol(addr string) {
+	s.listeners.enableProxyProtocol(addr)
+}
+
+// enableProxyProtocol requires a PROXY protocol header on connections
+// accepted by the listener for addr.
+func (l *listeners) enableProxyProtocol(addr string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.proxyProtocol == nil {
+		l.proxyProtocol = make(map[string]bool)
+	}
+	l.proxyProtocol[addr] = true
+}
+
+// SetProxyProtocolBypass allows connections accepted by the listener for addr
+// from the provided CIDR ranges, such as the source of a load balancer's
+// health checks, to omit the PROXY protocol header when it is enabled for
+// addr.  Their remote and local addresses are those of the connection itself.
+// Connections from other addresses still require the header.  The ranges
+// replace any set before, and are consulted as each connection is accepted,
+// so a listener created for addr later also honors them.  Without any ranges,
+// every connection requires the header again.  An error is returned, and
+// nothing changes, if any range can not be parsed.
+func (s *Server) SetProxyProtocolBypass(addr string, cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	s.listeners.setProxyBypassNets(addr, nets)
+	return nil
+}
+
+// setProxyBypassNets allows connections accepted by the listener for addr from
+// the provided networks to omit the PROXY protocol header, or requires it of
+// every connection if there are none.
+func (l *listeners) setProxyBypassNets(addr string, nets []*net.IPNet) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(nets) == 0 {
+		delete(l.proxyBypassNets, addr)
+		return
+	}
+	if l.proxyBypassNets == nil {
+		l.proxyBypassNets = make(map[string][]*net.IPNet)
+	}
+	l.proxyBypassNets[addr] = nets
+}
+
+// proxyProtocolRequired returns true if the provided connection, accepted by
+// the listener for addr, must begin with a PROXY protocol header.
+func (l *listeners) proxyProtocolRequired(addr string, c net.Conn) bool {
+	l.RLock()
+	enabled, nets := l.proxyProtocol[addr], l.proxyBypassNets[addr]
+	l.RUnlock()
+	return enabled && !netsContain(nets, c.RemoteAddr())
+}
+
+// proxyConn is a connection that begins with a PROXY protocol header.  The
+// header is read on first use of the connection, rather than when it is
+// accepted, so that a slow client does not hold up the listener.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once         sync.Once
+	err          error
+	remote       net.Addr
+	local        net.Addr
+	deadlineLock sync.Mutex
+	deadline     time.Time
+}
+
+// newProxyConn returns a connection that reads a PROXY protocol header from c.
+func newProxyConn(c net.Conn) *proxyConn {
+	return &proxyConn{
+		Conn:   c,
+		reader: bufio.NewReader(c),
+	}
+}
+
+// Read implements the Read() method of the net.Conn interface.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr implements the RemoteAddr() method of the net.Conn interface.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr implements the LocalAddr() method of the net.Conn interface.
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// SetDeadline implements the SetDeadline() method of the net.Conn interface.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.deadline = t
+	c.deadlineLock.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements the SetReadDeadline() method of the net.Conn
+// interface.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.deadline = t
+	c.deadlineLock.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// acceptedRemoteAddr returns the remote address of the provided connection as
+// it was accepted, rather than the address from its PROXY protocol header, so
+// that it does not wait for the client to send the header.
+func acceptedRemoteAddr(c net.Conn) net.Addr {
+	for {
+		switch wrapped := c.(type) {
+		case *conn:
+			c = wrapped.Conn
+		case *proxyConn:
+			return wrapped.Conn.RemoteAddr()
+		default:
+			return c.RemoteAddr()
+		}
+	}
+}
+
+// readHeader reads the PROXY protocol header, limiting how long the client has
+// to send it.  Any read deadline set on the connection is restored afterwards,
+// and the connection is closed if the header is invalid.
+func (c *proxyConn) readHeader() {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	deadline := time.Now().Add(proxyHeaderTimeout)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	c.Conn.SetReadDeadline(deadline)
+	c.remote, c.local, c.err = readProxyHeader(c.reader)
+	c.Conn.SetReadDeadline(c.deadline)
+
+	// The client is not speaking the protocol we expect, so don't respond to
+	// it at all.
+	if c.err != nil {
+		c.Conn.Close()
+	}
+}
+
+// readProxyHeader reads a version 1 or version 2 PROXY protocol header, and
+// returns the source and destination addresses it contains.  The addresses are
+// nil if the header does not describe a proxied TCP connection.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// Only as much is peeked as is needed to tell the versions apart, as the
+	// shortest version 1 header is shorter than the version 2 signature.
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		return readProxyV1Header(r)
+	case proxyV2Signature[0]:
+		signature, err := r.Peek(len(proxyV2Signature))
+		if err != nil {
+			return nil, nil, err
+		}
+		if bytes.Equal(signature, proxyV2Signature) {
+			return readProxyV2Header(r)
+		}
+	}
+	return nil, nil, errInvalidProxyHeader
+}
+
+// readProxyV1Header reads a version 1, text based, PROXY protocol header.
+func readProxyV1Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errInvalidProxyHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2Header reads a version 2, binary, PROXY protocol header.
+func readProxyV2Header(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	if command := versionCommand & 0x0f; command == proxyV2Local {
+		// LOCAL connections were made by the proxy itself, rather than on
+		// behalf of a client.
+		return nil, nil, nil
+	} else if command != proxyV2Proxy {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	var ipLength int
+	switch family {
+	case proxyV2TCP4:
+		ipLength = net.IPv4len
+	case proxyV2TCP6:
+		ipLength = net.IPv6len
+	default:
+		// Only TCP over IPv4 and IPv6 is supported.
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLength+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	srcIP := net.IP(body[:ipLength])
+	dstIP := net.IP(body[ipLength : 2*ipLength])
+	srcPort := binary.BigEndian.Uint16(body[2*ipLength:])
+	dstPort := binary.BigEndian.Uint16(body[2*ipLength+2:])
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
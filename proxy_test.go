@@ -0,0 +1,153 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEnableProxyProtocol(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ServeMux.HandleFunc("/remote", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	server.EnableProxyProtocol(addrs[0])
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	v2 := func(family byte, src, dst net.IP, srcPort, dstPort uint16) []byte {
+		header := append([]byte(nil), proxyV2Signature...)
+		header = append(header, 0x20|proxyV2Proxy, family, 0, 0)
+		header = append(header, src...)
+		header = append(header, dst...)
+		header = binary.BigEndian.AppendUint16(header, srcPort)
+		header = binary.BigEndian.AppendUint16(header, dstPort)
+		binary.BigEndian.PutUint16(header[14:16], uint16(len(header)-16))
+		return header
+	}
+	tests := []struct {
+		header []byte
+		remote string
+	}{
+		{[]byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n"), "192.0.2.1:5000"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 5001 443\r\n"), "[2001:db8::1]:5001"},
+		{v2(proxyV2TCP4, net.ParseIP("192.0.2.3").To4(), net.ParseIP("192.0.2.4").To4(), 5002, 443), "192.0.2.3:5002"},
+		{v2(proxyV2TCP6, net.ParseIP("2001:db8::3"), net.ParseIP("2001:db8::4"), 5003, 443), "[2001:db8::3]:5003"},
+	}
+	for _, test := range tests {
+		remote, err := proxyRequest(addrs[0], test.header)
+		if err != nil {
+			t.Errorf("Expected no error from %v, received '%v'.", addrs[0], err)
+		} else if remote != test.remote {
+			t.Errorf("Expected remote address '%v', received '%v'.", test.remote, remote)
+		}
+	}
+
+	// Ensure that connections without a header are refused.
+	if _, err = proxyRequest(addrs[0], nil); err == nil {
+		t.Error("Expected an error when the PROXY protocol header is missing.")
+	}
+}
+
+func TestSetProxyProtocolBypass(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ServeMux.HandleFunc("/remote", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	})
+	if err = server.SetProxyProtocolBypass(addrs[0], "invalid"); err == nil {
+		t.Error("Expected an error for an invalid CIDR.")
+	}
+	for _, addr := range addrs {
+		server.EnableProxyProtocol(addr)
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	if err = server.SetProxyProtocolBypass(addrs[0], "127.0.0.0/8"); err != nil {
+		t.Fatalf("Expected no error setting the bypass, received '%v'.", err)
+	}
+	if err = server.SetProxyProtocolBypass(addrs[1], "192.0.2.0/24"); err != nil {
+		t.Fatalf("Expected no error setting the bypass, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the health check source may omit the header.
+	remote, err := proxyRequest(addrs[0], nil)
+	if err != nil {
+		t.Errorf("Expected no error from %v, received '%v'.", addrs[0], err)
+	} else if host, _, _ := net.SplitHostPort(remote); host != "127.0.0.1" {
+		t.Errorf("Expected remote address '127.0.0.1', received '%v'.", remote)
+	}
+
+	// Ensure that other sources still require it.
+	if _, err = proxyRequest(addrs[1], nil); err == nil {
+		t.Error("Expected an error when the PROXY protocol header is missing.")
+	}
+	header := []byte("PROXY TCP4 192.0.2.1 192.0.2.2 5000 443\r\n")
+	if remote, err = proxyRequest(addrs[1], header); err != nil {
+		t.Errorf("Expected no error from %v, received '%v'.", addrs[1], err)
+	} else if remote != "192.0.2.1:5000" {
+		t.Errorf("Expected remote address '192.0.2.1:5000', received '%v'.", remote)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	client, c := net.Pipe()
+	defer client.Close()
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(time.Second))
+
+	// Ensure that the shortest valid header is read without waiting for more
+	// data than it contains.
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+	src, dst, err := readProxyHeader(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("Expected no error reading the header, received '%v'.", err)
+	}
+	if src != nil || dst != nil {
+		t.Errorf("Expected no addresses, received '%v' and '%v'.", src, dst)
+	}
+
+	// Ensure that the accepted address is available before the header has
+	// been sent.
+	proxied := newProxyConn(c)
+	if addr := acceptedRemoteAddr(proxied); addr != c.RemoteAddr() {
+		t.Errorf("Expected the accepted remote address '%v', received '%v'.", c.RemoteAddr(), addr)
+	}
+}
+
+// proxyRequest sends the provided PROXY protocol header, followed by a request
+// for the remote address that the server sees.
+func proxyRequest(addr string, header []byte) (string, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	c.Write(header)
+	c.Write([]byte("GET /remote HTTP/1.0\r\nHost: " + addr + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
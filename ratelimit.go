@@ -0,0 +1,95 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdleTimeout is how long a client may go without making a request
+// before its rate limiter is discarded.  A client that returns afterwards
+// starts with a full burst again, as it would have regained it anyway.
+const rateLimitIdleTimeout = 3 * time.Minute
+
+// EnableRateLimit limits each client, by IP address, to an average of rps
+// requests per second, with bursts of up to burst requests.  Requests over
+// the limit receive a 429 Too Many Requests response, and are not passed to
+// the handler.  The limiters of clients that have been idle for a few minutes
+// are discarded, so that memory use is bounded by the number of recently
+// active clients.  The limit is applied at the point in the middleware chain
+// where EnableRateLimit is called, so middleware registered earlier, such as
+// an access log, still sees the requests that are rejected.
+func (s *Server) EnableRateLimit(rps float64, burst int) {
+	limiters := &rateLimiters{
+		limit:    rate.Limit(rps),
+		burst:    burst,
+		limiters: make(map[string]*rateLimiter),
+	}
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !limiters.allow(clientIP(r), time.Now()) {
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// clientIP returns the IP address of the client that made the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiters holds a rate limiter for each client that has made a request
+// recently.
+type rateLimiters struct {
+	limit rate.Limit
+	burst int
+
+	mutex     sync.Mutex
+	limiters  map[string]*rateLimiter
+	lastSweep time.Time
+}
+
+// rateLimiter is the rate limiter of a single client.
+type rateLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+// allow returns true if the client with the provided IP address may make a
+// request at the provided time.  Idle limiters are discarded at most once per
+// idle timeout, so that the cost of doing so is spread across many requests.
+func (l *rateLimiters) allow(ip string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitIdleTimeout {
+		for key, limiter := range l.limiters {
+			if now.Sub(limiter.lastSeen) >= rateLimitIdleTimeout {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	limiter, ok := l.limiters[ip]
+	if !ok {
+		limiter = &rateLimiter{Limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = limiter
+	}
+	limiter.lastSeen = now
+	return limiter.AllowN(now, 1)
+}
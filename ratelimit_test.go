@@ -0,0 +1,54 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestEnableRateLimit(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.EnableRateLimit(1, 3)
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the burst is allowed, and the request after it is not.
+	for i := 0; i < 4; i++ {
+		resp, err := http.Get("http://" + addrs[0] + simpleRoute)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		resp.Body.Close()
+		expected := http.StatusOK
+		if i == 3 {
+			expected = http.StatusTooManyRequests
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("Expected status %v for request %v, received '%v'.", expected, i+1, resp.StatusCode)
+		}
+	}
+}
+
+func TestRateLimitersEviction(t *testing.T) {
+	limiters := &rateLimiters{limit: 1, burst: 1, limiters: make(map[string]*rateLimiter)}
+	now := time.Now()
+	limiters.allow("192.0.2.1", now)
+	limiters.allow("192.0.2.2", now.Add(rateLimitIdleTimeout/2))
+
+	// Ensure that only the idle limiter is discarded.
+	limiters.allow("192.0.2.3", now.Add(rateLimitIdleTimeout))
+	if _, ok := limiters.limiters["192.0.2.1"]; ok {
+		t.Error("Expected the idle limiter to be discarded.")
+	}
+	if len(limiters.limiters) != 2 {
+		t.Errorf("Expected 2 limiters, received '%v'.", len(limiters.limiters))
+	}
+}
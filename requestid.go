@@ -0,0 +1,56 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// defaultRequestIDHeader is the header that carries request IDs when
+// EnableRequestID is not given one.
+const defaultRequestIDHeader = "X-Request-ID"
+
+// requestIDContextKey is the context key used to store the ID of a request.
+type requestIDContextKey struct{}
+
+// EnableRequestID gives every request an ID, which is read from the provided
+// request header, or generated if the request does not have one.  The ID is
+// stored in the request's context, where RequestIDFromContext finds it, and is
+// echoed in the same header of the response, so that requests can be
+// correlated across services.  The header defaults to X-Request-ID.  The ID is
+// added to the request as it passes through, so only the handler and
+// middleware registered after this call can read it from the context.
+func (s *Server) EnableRequestID(header string) {
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+	s.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if id == "" {
+				id = newRequestID()
+			}
+			w.Header().Set(header, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+		})
+	})
+}
+
+// RequestIDFromContext returns the ID of the request that the provided context
+// belongs to, or an empty string if it does not have one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// newRequestID returns a new, randomly generated, request ID.
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,60 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestEnableRequestID(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.EnableRequestID("")
+	server.HandleFunc("/id", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, RequestIDFromContext(r.Context()))
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	get := func(id string) (string, string) {
+		req, err := http.NewRequest("GET", "http://"+addrs[0]+"/id", nil)
+		if err != nil {
+			t.Fatalf("Expected no error creating the request, received '%v'.", err)
+		}
+		req.Close = true
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Expected no error reading the response, received '%v'.", err)
+		}
+		return string(body), resp.Header.Get("X-Request-ID")
+	}
+
+	// Ensure that an ID is generated when the request does not have one.
+	first, echoed := get("")
+	if len(first) != 32 || echoed != first {
+		t.Errorf("Expected a generated ID to be seen and echoed, received '%v' and '%v'.", first, echoed)
+	}
+	if second, _ := get(""); second == first {
+		t.Errorf("Expected each request to receive a new ID, received '%v' twice.", first)
+	}
+
+	// Ensure that an incoming ID is passed through.
+	if seen, echoed := get("upstream-id"); seen != "upstream-id" || echoed != "upstream-id" {
+		t.Errorf("Expected the incoming ID to be seen and echoed, received '%v' and '%v'.", seen, echoed)
+	}
+}
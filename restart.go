@@ -0,0 +1,101 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+// inheritedListenersEnv is the environment variable that Restart uses to tell
+// the new process which descriptors belong to which addresses.
+const inheritedListenersEnv = "GO_SERVER_INHERITED_LISTENERS"
+
+// firstInheritedFD is the descriptor of the first extra file passed to a new
+// process, following standard input, output, and error.
+const firstInheritedFD = 3
+
+// Restart detaches all listeners, and starts a new instance of the current
+// binary, with the same arguments, that inherits them.  The new process should
+// pass InheritedListeners to ReuseListeners before it begins listening.  This
+// server keeps serving connections, and should be shut down once Restart
+// returns without an error.
+func (s *Server) Restart() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	env, files, err := inheritListeners(s.Detach())
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   append(environWithout(inheritedListenersEnv), env),
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+	return err
+}
+
+// InheritedListeners returns the listeners that were passed to this process by
+// Restart, or an empty mapping if there are none.  The environment variable
+// describing them is removed, so that they are not inherited again by
+// processes that this process starts.
+func InheritedListeners() DetachedListeners {
+	listeners := DetachedListeners{}
+	value, ok := os.LookupEnv(inheritedListenersEnv)
+	if !ok {
+		return listeners
+	}
+	os.Unsetenv(inheritedListenersEnv)
+
+	if err := json.Unmarshal([]byte(value), &listeners); err != nil {
+		return DetachedListeners{}
+	}
+	return listeners
+}
+
+// inheritListeners returns the environment variable, and the files, that pass
+// the detached listeners to a new process.  The descriptors in the environment
+// variable are the ones that the files will have in the new process.
+func inheritListeners(detached DetachedListeners) (string, []*os.File, error) {
+	addrs := make([]string, 0, len(detached))
+	for addr := range detached {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	inherited := make(DetachedListeners, len(detached))
+	files := make([]*os.File, 0, len(detached))
+	for i, addr := range addrs {
+		files = append(files, os.NewFile(detached[addr], addr))
+		inherited[addr] = uintptr(firstInheritedFD + i)
+	}
+	value, err := json.Marshal(inherited)
+	if err != nil {
+		return "", files, err
+	}
+	return inheritedListenersEnv + "=" + string(value), files, nil
+}
+
+// environWithout returns the environment, without the provided variable.
+func environWithout(name string) []string {
+	environ := os.Environ()
+	env := make([]string, 0, len(environ))
+	for _, v := range environ {
+		if !strings.HasPrefix(v, name+"=") {
+			env = append(env, v)
+		}
+	}
+	return env
+}
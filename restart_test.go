@@ -0,0 +1,64 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+
+	env, files, err := inheritListeners(server.Detach())
+	for _, file := range files {
+		defer file.Close()
+	}
+	if err != nil {
+		t.Fatalf("Expected no error when inheriting listeners, received '%v'.", err)
+	}
+	if len(files) != len(addrs) {
+		t.Fatalf("Expected %v files, received '%v'.", len(addrs), len(files))
+	}
+
+	// Ensure that the mapping survives the trip through the environment, and
+	// names the descriptors that the new process will see.
+	parts := strings.SplitN(env, "=", 2)
+	if len(parts) != 2 || parts[0] != inheritedListenersEnv {
+		t.Fatalf("Expected a %v variable, received '%v'.", inheritedListenersEnv, env)
+	}
+	os.Setenv(parts[0], parts[1])
+	defer os.Unsetenv(parts[0])
+
+	inherited := InheritedListeners()
+	if len(inherited) != len(addrs) {
+		t.Fatalf("Expected %v inherited listeners, received '%v'.", len(addrs), len(inherited))
+	}
+	for i, addr := range addrs {
+		if fd, ok := inherited[addr]; !ok || fd != uintptr(firstInheritedFD+i) {
+			t.Errorf("Expected descriptor %v for %v, received '%v'.", firstInheritedFD+i, addr, fd)
+		}
+		if files[i].Name() != addr {
+			t.Errorf("Expected file for %v at position %v, received '%v'.", addr, i, files[i].Name())
+		}
+	}
+
+	// Ensure that the listeners are only inherited once.
+	if _, ok := os.LookupEnv(inheritedListenersEnv); ok {
+		t.Error("Expected the environment variable to be removed.")
+	}
+	if inherited = InheritedListeners(); len(inherited) != 0 {
+		t.Errorf("Expected no inherited listeners, received '%v'.", inherited)
+	}
+}
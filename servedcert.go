@@ -0,0 +1,109 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+)
+
+// ServedCertificate returns the certificate that the server presented on the
+// connection the provided request was received on, or nil if the connection
+// does not use TLS.  When the server has several certificates, this shows which
+// one was selected for the client.
+func ServedCertificate(r *http.Request) *x509.Certificate {
+	c, ok := r.Context().Value(connContextKey{}).(*conn)
+	if !ok || c.certificate == nil {
+		return nil
+	}
+	leaf, err := leafCertificate(*c.certificate)
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// recordCertificates changes the provided TLS configuration so that the
+// certificate it presents during each handshake is recorded on the connection.
+// The configuration itself is still used for the handshake, rather than a copy,
+// so that its session ticket keys are shared by all of its connections.
+func recordCertificates(config *tls.Config) {
+	if getCertificate := config.GetCertificate; getCertificate != nil {
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := getCertificate(hello)
+			if cert != nil {
+				setCertificate(hello, cert)
+			}
+			return cert, err
+		}
+	}
+	getConfigForClient := config.GetConfigForClient
+	if len(config.Certificates) == 0 && getConfigForClient == nil {
+		return
+	}
+
+	// GetConfigForClient is called before any certificate is selected, so it
+	// records the certificate that would be selected from Certificates, which
+	// GetCertificate then replaces if it provides one.
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if getConfigForClient != nil {
+			selected, err := getConfigForClient(hello)
+			if err != nil || selected == nil {
+				setCertificate(hello, staticCertificate(config, hello))
+				return selected, err
+			}
+			// A copy without session ticket keys of its own still uses those
+			// of the original configuration.
+			selected = selected.Clone()
+			recordCertificates(selected)
+			setCertificate(hello, staticCertificate(selected, hello))
+			return selected, nil
+		}
+		setCertificate(hello, staticCertificate(config, hello))
+		return nil, nil
+	}
+}
+
+// setCertificate records the provided certificate on the connection the
+// ClientHello was received on.
+func setCertificate(hello *tls.ClientHelloInfo, cert *tls.Certificate) {
+	if c, ok := hello.Conn.(*conn); ok {
+		c.certificate = cert
+	}
+}
+
+// staticCertificate returns the certificate that crypto/tls selects from the
+// provided configuration's Certificates for the ClientHello, or nil if there
+// are none.
+func staticCertificate(config *tls.Config, hello *tls.ClientHelloInfo) *tls.Certificate {
+	switch len(config.Certificates) {
+	case 0:
+		return nil
+	case 1:
+		return &config.Certificates[0]
+	}
+
+	if config.NameToCertificate != nil {
+		name := strings.ToLower(hello.ServerName)
+		if cert, ok := config.NameToCertificate[name]; ok {
+			return cert
+		}
+		if len(name) > 0 {
+			labels := strings.Split(name, ".")
+			labels[0] = "*"
+			if cert, ok := config.NameToCertificate[strings.Join(labels, ".")]; ok {
+				return cert
+			}
+		}
+	}
+	for i := range config.Certificates {
+		if hello.SupportsCertificate(&config.Certificates[i]) == nil {
+			return &config.Certificates[i]
+		}
+	}
+	return &config.Certificates[0]
+}
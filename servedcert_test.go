@@ -0,0 +1,79 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestServedCertificate(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ServeMux.HandleFunc("/certificate", func(w http.ResponseWriter, r *http.Request) {
+		if cert := ServedCertificate(r); cert != nil {
+			w.Write([]byte(cert.Subject.CommonName))
+		}
+	})
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that the certificate selected for each server name is reported.
+	for _, serverName := range addrToServerName {
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName: serverName,
+				RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+			},
+		}
+		resp, err := (&http.Client{Transport: transport}).Get("https://" + addrs[0] + "/certificate")
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		transport.CloseIdleConnections()
+		presented := resp.TLS.PeerCertificates[0].Subject.CommonName
+		if string(body) != presented {
+			t.Errorf("Expected '%v' to be reported for %v, received '%v'.", presented, serverName, string(body))
+		}
+		if presented != serverName {
+			t.Errorf("Expected the certificate for %v to be presented, received '%v'.", serverName, presented)
+		}
+	}
+}
+
+func TestServedCertificatePlainHTTP(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	reported := make(chan bool, 1)
+	server.ServeMux.HandleFunc("/certificate", func(w http.ResponseWriter, r *http.Request) {
+		reported <- ServedCertificate(r) != nil
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that no certificate is reported without TLS.
+	if err := httpRequestSuccess(addrs[0], "/certificate"); err != nil {
+		t.Fatal(err)
+	}
+	if <-reported {
+		t.Error("Expected no certificate to be reported for a plain HTTP request.")
+	}
+}
@@ -9,9 +9,30 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // A list of strong cipher suite IDs that are not defined by the crypto/tls
@@ -42,26 +63,311 @@ const (
 	TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384   uint16 = 0xc030
 )
 
+// SNIMismatchPolicy determines how TLS connections are handled when the server
+// name requested by the client does not match any certificate.
+type SNIMismatchPolicy int
+
+// SNI mismatch policies.
+const (
+	// SNIMismatchFailHandshake presents the default (first) certificate,
+	// which the client will be unable to verify, causing the handshake to
+	// fail.  This is the default.
+	SNIMismatchFailHandshake SNIMismatchPolicy = iota
+	// SNIMismatchReject presents the default (first) certificate, and then
+	// rejects each request with a 421 Misdirected Request, so that clients
+	// which accept the certificate receive an application-level error.
+	SNIMismatchReject
+)
+
+// ErrAlreadyListening is returned when listening on an address that the server
+// already has a listener for, other than one that is being reused.
+var ErrAlreadyListening = errors.New("already listening")
+
+// ErrShuttingDown is the cause of the cancellation of a request's context when
+// the server begins shutting down, if CancelRequestsOnShutdown is set.
+var ErrShuttingDown = errors.New("server: shutting down")
+
 // Server is a simple HTTP/HTTPS server.
 type Server struct {
+	// ServeMux routes the server's requests.  Each server has its own, and
+	// handlers must be registered with it, rather than with
+	// http.DefaultServeMux, which the server never consults.
 	*http.ServeMux
-	TLS            *tls.Config
-	listeners      *listeners
-	reuseListeners DetachedListeners
+	TLS      *tls.Config
+	tlsMutex sync.RWMutex
+
+	// SNIMismatchPolicy determines how TLS connections that request a server
+	// name that does not match any certificate are handled.
+	SNIMismatchPolicy SNIMismatchPolicy
+
+	// MaxConnections is the maximum number of connections that may be active
+	// at once, across all listeners.  Zero means no limit.
+	MaxConnections int
+	// ConnectionQueueTimeout is how long a new connection will wait for
+	// capacity to free up once MaxConnections has been reached.  Connections
+	// that are still waiting when the timeout expires are rejected.  Zero
+	// means connections are rejected immediately.
+	ConnectionQueueTimeout time.Duration
+	// MaxQueuedConnections is the maximum number of connections that may
+	// wait for capacity at once.  Connections arriving once the queue is full
+	// are rejected immediately.  Zero means the queue is bounded only by
+	// ConnectionQueueTimeout.
+	MaxQueuedConnections int
+	// OnConnectionRejected, if set, is called whenever a connection is
+	// rejected, with the remote address of the connection and the reason it
+	// was rejected.  It is called from the listener's accept loop, so it
+	// should return quickly.
+	OnConnectionRejected func(remoteAddr string, reason RejectionReason)
+	// ListenFunc is used to create new listeners.  It defaults to net.Listen,
+	// and can be replaced to provide in-memory listeners for testing, or
+	// alternative transports.
+	ListenFunc func(network, addr string) (net.Listener, error)
+	// MaxConcurrentStreams limits the number of HTTP/2 streams, and so
+	// requests, that a client may have open at once on a single connection.
+	// Zero means the net/http default.
+	MaxConcurrentStreams uint32
+	// Transparent sets IP_TRANSPARENT on new listeners, which allows them to
+	// accept connections destined for addresses that are not local, as is
+	// required for transparent proxying.  When set, listeners are created
+	// with ListenTransparent rather than ListenFunc.  See ListenTransparent
+	// for the requirements.
+	Transparent bool
+	// ErrorHandler is called when a listener stops serving connections due to
+	// an error.  If nil, the error is written to ErrorWriter instead.
+	ErrorHandler func(addr string, err error)
+	// ErrorWriter is where errors are logged.  It defaults to os.Stderr.
+	ErrorWriter io.Writer
+	// Logger, if set, is used instead of ErrorWriter.  Along with errors,
+	// including those logged by each listener's http.Server such as failed
+	// TLS handshakes, it receives informational events such as the start and
+	// completion of a shutdown.
+	Logger *log.Logger
+	// KeepAliveIdle, KeepAliveInterval, and KeepAliveCount configure TCP
+	// keep-alive probing on accepted connections, which allows the operating
+	// system to detect and close connections to peers that have gone away.
+	// They are, respectively, how long a connection must be idle before
+	// probing begins, how long to wait between probes, and how many
+	// unanswered probes are allowed before the connection is closed.  Zero
+	// values leave the operating system defaults in place, and probing is only
+	// configured if at least one of them is set.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// TCPKeepAlivePeriod sets both how long a connection must be idle before
+	// keep-alive probing begins, and how long to wait between probes, as
+	// net.TCPConn's SetKeepAlivePeriod does.  KeepAliveIdle and
+	// KeepAliveInterval take precedence over it when set.  Zero leaves
+	// probing as the listener set it up, which for listeners created by the
+	// net package means Go's defaults of probing every 15 seconds once a
+	// connection has been idle for 15 seconds.  Zero does not disable
+	// probing, so that a Server that does not set it behaves like net/http;
+	// a negative value disables keep-alive probing on accepted connections
+	// entirely.
+	TCPKeepAlivePeriod time.Duration
+	// ReadTimeout, WriteTimeout, and IdleTimeout are applied to each listener's
+	// http.Server, and bound, respectively, how long reading a request may
+	// take, how long writing a response may take, and how long a keep-alive
+	// connection may wait for its next request.  Zero means no timeout, except
+	// that a zero IdleTimeout falls back to ReadTimeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// MaxHeaderBytes is applied to each listener's http.Server, and limits the
+	// size of the request headers, including the request line, that a client
+	// may send.  Requests with larger headers are rejected with a 431 Request
+	// Header Fields Too Large.  Zero means http.DefaultMaxHeaderBytes (1MB).
+	MaxHeaderBytes int
+	// TLSHandshakeTimeout bounds how long a client has to complete the TLS
+	// handshake once its connection has been accepted, after which the
+	// connection is closed.  This prevents clients that stall the handshake
+	// from holding connections open indefinitely.  Zero means no timeout.
+	TLSHandshakeTimeout time.Duration
+	// TLSClientSessionCache is used as the ClientSessionCache of the server's
+	// TLS configuration, for connections where the server's configuration is
+	// used to act as a TLS client, such as when proxying to upstreams over
+	// TLS.  It has no effect on connections accepted by the server, whose
+	// session resumption is controlled by the session ticket keys instead;
+	// see RotateSessionTicketKeys and SetSessionTicketKeys, or set
+	// SessionTicketsDisabled on the TLS configuration to disable resumption.
+	// It must be set before the TLS configuration is created, which happens
+	// when it is first changed, such as by adding a certificate.
+	TLSClientSessionCache tls.ClientSessionCache
+	// AllowInvalidCertificates allows AddTLSCertificate and
+	// AddTLSCertificateFromFile to add certificates that are expired or not
+	// yet valid, which they otherwise refuse, as such certificates only cause
+	// handshakes to fail later.  A warning is logged for each one added.
+	AllowInvalidCertificates bool
+	// ConnState, if set, is called when a connection changes state, as with
+	// http.Server's ConnState.
+	ConnState func(net.Conn, http.ConnState)
+	// PanicHandler, if set, is called when a handler panics, with the value
+	// that was recovered, and is responsible for writing the response.  If
+	// nil, the panic is handled by the net/http package, which logs it and
+	// closes the connection.
+	PanicHandler func(w http.ResponseWriter, r *http.Request, recovered interface{})
+	// CancelRequestsOnShutdown cancels the context of every request being
+	// served when the server begins shutting down, so that handlers doing
+	// long operations can select on r.Context().Done() and finish early.  The
+	// context is also canceled when the client goes away; when it is
+	// canceled because of a shutdown, context.Cause returns ErrShuttingDown.
+	// It must be set before the server begins serving connections.
+	CancelRequestsOnShutdown bool
+	// ShutdownRetryAfter is sent in the Retry-After header of the 503 Service
+	// Unavailable responses to requests that arrive on a listener once it
+	// has begun shutting down, rounded up to whole seconds.  Zero means 5
+	// seconds.
+	ShutdownRetryAfter time.Duration
+	// BeforeShutdown, if set, is called at the very start of a graceful
+	// shutdown, by Shutdown, ShutdownWithTimeout, and ShutdownContext, while
+	// listeners are still accepting connections.  The shutdown waits for it
+	// to return, so it can deregister the server from service discovery, and
+	// then wait for clients to stop being routed to it.  The time it takes is
+	// not counted against ShutdownWithTimeout's timeout.  It is not called by
+	// ForceShutdown.
+	BeforeShutdown func()
+	// OnDrainProgress, if set, is called with the number of requests still
+	// being served, and the number of connections still open, when a shutdown
+	// begins, and then every second until the shutdown completes.  This helps
+	// diagnose handlers and connections, such as hijacked ones, that hold up
+	// a shutdown.  It is not called while there are neither.
+	OnDrainProgress func(requests, connections int)
+	// GoroutineWarningThreshold is the number of goroutines running on behalf
+	// of the server, as reported by Stats, above which a warning is logged.
+	// Unexpected growth usually indicates a leak.  Zero disables the warning.
+	GoroutineWarningThreshold int
+
+	// draining is accessed atomically, and is set from when the server
+	// begins shutting down until it begins serving again.
+	draining int32
+
+	listeners       *listeners
+	reuseListeners  DetachedListeners
+	routesMutex     sync.Mutex
+	routes          []route
+	shutdownWebhook string
+	barriersMutex   sync.Mutex
+	barriers        []Barrier
+	ocspMutex       sync.Mutex
+	stopOCSP        context.CancelFunc
+	expiryMutex     sync.Mutex
+	stopExpiry      context.CancelFunc
+	ticketMutex     sync.Mutex
+	requestsMutex   sync.Mutex
+	requestsCtx     context.Context
+	cancelRequests  context.CancelCauseFunc
+	errorsMutex     sync.Mutex
+	listenerErrors  chan ListenerError
+	stopTickets     func()
+	middlewareMutex sync.RWMutex
+	middleware      []func(http.Handler) http.Handler
+	handler         http.Handler
+	rootHandler     http.Handler
+	handlerTimeout  time.Duration
+	timeoutMessage  string
+	maxBodySize     int64
+	trustedProxies  []*net.IPNet
+	h2c             bool
+	httpConfig      func(*http.Server)
+
+	startupMutex   sync.Mutex
+	startupBegan   time.Time
+	startupMetrics StartupMetrics
 }
 
 // New creates a new Server.
 func New() *Server {
-	return &Server{
+	s := &Server{
 		ServeMux:       http.NewServeMux(),
 		TLS:            nil,
-		listeners:      &listeners{},
+		ListenFunc:     net.Listen,
 		reuseListeners: DetachedListeners{},
 	}
+	s.listeners = &listeners{server: s}
+	return s
+}
+
+// Clone creates a new Server with the same configuration as s, such as a
+// sibling server that shares its TLS settings, but with no listeners.  The TLS
+// configuration is copied, so that changes to one server's do not affect the
+// other's, as are the exported fields, middleware, handler, handler timeout,
+// body size limit, trusted proxies, and connection rate limit.  The clone has
+// its own ServeMux, with the handlers that were registered with Handle and
+// HandleFunc registered again.  Handlers registered directly with the
+// original's ServeMux can not be found, so they are not copied.
+func (s *Server) Clone() *Server {
+	c := New()
+	s.routesMutex.Lock()
+	for _, r := range s.routes {
+		c.Handle(r.pattern, r.handler)
+	}
+	s.routesMutex.Unlock()
+	c.SNIMismatchPolicy = s.SNIMismatchPolicy
+	c.MaxConnections = s.MaxConnections
+	c.ConnectionQueueTimeout = s.ConnectionQueueTimeout
+	c.MaxQueuedConnections = s.MaxQueuedConnections
+	c.OnConnectionRejected = s.OnConnectionRejected
+	c.ListenFunc = s.ListenFunc
+	c.Transparent = s.Transparent
+	c.ErrorHandler = s.ErrorHandler
+	c.ErrorWriter = s.ErrorWriter
+	c.Logger = s.Logger
+	c.KeepAliveIdle = s.KeepAliveIdle
+	c.KeepAliveInterval = s.KeepAliveInterval
+	c.KeepAliveCount = s.KeepAliveCount
+	c.TCPKeepAlivePeriod = s.TCPKeepAlivePeriod
+	c.ReadTimeout = s.ReadTimeout
+	c.WriteTimeout = s.WriteTimeout
+	c.IdleTimeout = s.IdleTimeout
+	c.MaxHeaderBytes = s.MaxHeaderBytes
+	c.MaxConcurrentStreams = s.MaxConcurrentStreams
+	c.TLSHandshakeTimeout = s.TLSHandshakeTimeout
+	c.TLSClientSessionCache = s.TLSClientSessionCache
+	c.AllowInvalidCertificates = s.AllowInvalidCertificates
+	c.ConnState = s.ConnState
+	c.PanicHandler = s.PanicHandler
+	c.CancelRequestsOnShutdown = s.CancelRequestsOnShutdown
+	c.ShutdownRetryAfter = s.ShutdownRetryAfter
+	c.BeforeShutdown = s.BeforeShutdown
+	c.OnDrainProgress = s.OnDrainProgress
+	c.GoroutineWarningThreshold = s.GoroutineWarningThreshold
+	c.shutdownWebhook = s.shutdownWebhook
+	c.listeners.connRateLimit = atomic.LoadInt64(&s.listeners.connRateLimit)
+
+	s.tlsMutex.RLock()
+	if s.TLS != nil {
+		c.TLS = s.TLS.Clone()
+	}
+	s.tlsMutex.RUnlock()
+
+	s.middlewareMutex.RLock()
+	c.middleware = append([]func(http.Handler) http.Handler(nil), s.middleware...)
+	c.rootHandler = s.rootHandler
+	c.handlerTimeout, c.timeoutMessage = s.handlerTimeout, s.timeoutMessage
+	c.maxBodySize = s.maxBodySize
+	c.trustedProxies = s.trustedProxies
+	c.h2c = s.h2c
+	c.httpConfig = s.httpConfig
+	s.middlewareMutex.RUnlock()
+	if len(c.middleware) > 0 {
+		c.middlewareMutex.Lock()
+		c.buildHandler()
+		c.middlewareMutex.Unlock()
+	}
+	return c
+}
+
+// http2Config returns the HTTP/2 configuration used by each listener's
+// http.Server, or nil if the net/http defaults should be used.
+func (s *Server) http2Config() *http.HTTP2Config {
+	if s.MaxConcurrentStreams == 0 {
+		return nil
+	}
+	return &http.HTTP2Config{MaxConcurrentStreams: int(s.MaxConcurrentStreams)}
 }
 
 // ReuseListeners provides an address to file descriptor mapping of listeners
-// that the server can reuse instead of creating a new listener.
+// that the server can reuse instead of creating a new listener.  Descriptors
+// that are used are closed once the listener has been created from them.
 func (s *Server) ReuseListeners(listeners DetachedListeners) {
 	if listeners != nil {
 		s.reuseListeners = listeners
@@ -69,51 +375,776 @@ func (s *Server) ReuseListeners(listeners DetachedListeners) {
 }
 
 // Listen will begin listening on the given address, either by reusing an
-// existing listener, or by creating a new one.
+// existing listener, or by creating a new one.  Addresses beginning with
+// "unix:" listen on a Unix domain socket at the remainder of the address.  If
+// the server is already listening on the address, an error wrapping
+// ErrAlreadyListening is returned.
 func (s *Server) Listen(addr string) error {
+	_, err := s.ListenAddr(addr)
+	return err
+}
+
+// ListenAddr is the same as Listen, but also returns the address that the
+// listener is bound to.  This is useful for discovering the port that was
+// chosen when listening on port 0.
+func (s *Server) ListenAddr(addr string) (net.Addr, error) {
+	l, err := s.listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.Addr(), nil
+}
+
+// ListenUnix will begin listening on a Unix domain socket at the given path,
+// either by reusing an existing listener, or by creating a new one.  The
+// listener is known by the address "unix:" followed by the path, and the
+// socket file is removed when the listener is shut down.
+func (s *Server) ListenUnix(path string) error {
+	return s.Listen(unixPrefix + path)
+}
+
+// SetListenConfig creates new listeners with the provided net.ListenConfig,
+// by replacing ListenFunc.  This allows socket options, such as the type of
+// service, mark, or bound device, to be set by its Control function before the
+// socket is bound.  Transparent listeners are still created with
+// ListenTransparent.
+func (s *Server) SetListenConfig(lc net.ListenConfig) {
+	s.ListenFunc = func(network, addr string) (net.Listener, error) {
+		return lc.Listen(context.Background(), network, addr)
+	}
+}
+
+// ListenAll will begin listening on each of the given addresses, in the same
+// way as Listen.  If listening on any of them fails, the listeners created for
+// the preceding addresses are closed, and an error naming the failed address
+// is returned.
+func (s *Server) ListenAll(addrs ...string) error {
+	bound := make([]*listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := s.listen(addr)
+		if err != nil {
+			for _, l := range bound {
+				l.shutdown()
+				s.listeners.unmanage(l)
+			}
+			return fmt.Errorf("server: failed to listen on %v: %w", addr, err)
+		}
+		bound = append(bound, l)
+	}
+	return nil
+}
+
+// ListenOnInterface will begin listening on port at each address of the named
+// network interface, in the same way as ListenAll.  IPv6 link-local addresses
+// are qualified with the interface's name as their zone.  Zone qualified
+// addresses, such as "[fe80::1%eth0]:8080", may also be passed to Listen
+// directly.
+func (s *Server) ListenOnInterface(ifaceName string, port int) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	ifaceAddrs, err := iface.Addrs()
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]string, 0, len(ifaceAddrs))
+	for _, ifaceAddr := range ifaceAddrs {
+		ipNet, ok := ifaceAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipNet.IP.String()
+		if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			host += "%" + iface.Name
+		}
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("server: interface %v has no addresses", ifaceName)
+	}
+	return s.ListenAll(addrs...)
+}
+
+// Attach manages the provided listener, which begins serving connections on
+// the next call to Serve, and is closed when the server shuts down.  The
+// listener is known by the string form of its address.
+func (s *Server) Attach(l net.Listener) {
+	s.listeners.manage(l)
+}
+
+// ListenTLS will begin listening on the given address, either by reusing an
+// existing listener, or by creating a new one.  The listener uses the provided
+// TLS configuration, independent of the server's TLS configuration, and is
+// unaffected by certificates added to the server.
+func (s *Server) ListenTLS(addr string, config *tls.Config) error {
+	l, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
+	l.configureOwnTLS(config)
+	return nil
+}
+
+// RedirectToHTTPS will begin listening on httpAddr, in the same way as Listen,
+// and permanently redirect every request it receives to HTTPS on httpsHost,
+// preserving the path and query.  If httpsHost is empty, the host the request
+// was made to is used, without its port.  The listener never uses TLS, and its
+// requests do not pass through the ServeMux or middleware.
+func (s *Server) RedirectToHTTPS(httpAddr, httpsHost string) error {
+	l, err := s.listen(httpAddr)
+	if err != nil {
+		return err
+	}
+	l.configureOwnTLS(nil)
+	l.setHandler(httpsRedirectHandler(httpsHost))
+	return nil
+}
+
+// acmeChallengePath is the path prefix under which ACME HTTP-01 challenges are
+// served.
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// ACMEAndRedirectHandler returns a handler that serves ACME HTTP-01 challenges,
+// the requests under /.well-known/acme-challenge/, with challengeHandler, and
+// permanently redirects every other request to HTTPS on httpsHost, in the same
+// way as RedirectToHTTPS.  It is intended for serving cleartext HTTP alongside
+// HTTPS, such as by a second server, listening on port 80, that is given the
+// handler with SetHandler.
+func (s *Server) ACMEAndRedirectHandler(challengeHandler http.Handler, httpsHost string) http.Handler {
+	redirect := httpsRedirectHandler(httpsHost)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			challengeHandler.ServeHTTP(w, r)
+			return
+		}
+		redirect.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirectHandler returns a handler that permanently redirects every
+// request to HTTPS on httpsHost, as described by RedirectToHTTPS.
+func httpsRedirectHandler(httpsHost string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := httpsHost
+		if host == "" {
+			host = r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+				if strings.Contains(host, ":") {
+					host = "[" + host + "]"
+				}
+			}
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// listen begins listening on the given address, either by reusing an existing
+// listener, or by creating a new one.
+func (s *Server) listen(addr string) (*listener, error) {
+	start := time.Now()
 	if fd, exists := s.reuseListeners[addr]; exists {
-		if err := s.listeners.reuse(fd, addr); err == nil {
-			return nil
+		// The descriptor is closed by reuse, whether or not it succeeds, so
+		// it must not be used again; its number may since have been given to
+		// another socket.
+		delete(s.reuseListeners, addr)
+		if l, err := s.listeners.reuse(fd, addr); err == nil {
+			s.recordBind(addr, start, true)
+			return l, nil
 		}
-		syscall.Close(int(fd))
 	}
-	return s.listeners.new(addr)
+
+	if s.listeners.listening(addr) {
+		return nil, fmt.Errorf("server: %w on %v", ErrAlreadyListening, addr)
+	}
+	l, err := s.listeners.new(addr)
+	if err == nil {
+		s.recordBind(addr, start, false)
+	}
+	return l, err
+}
+
+// BindMetrics describes how long it took to begin listening on an address.
+type BindMetrics struct {
+	// Duration is how long it took for the listener to become ready.
+	Duration time.Duration
+	// Reused is true if an existing listener was reused.
+	Reused bool
+}
+
+// StartupMetrics describes how long it took for the server to start.
+type StartupMetrics struct {
+	// Binds maps addresses to how long it took to begin listening on them.
+	Binds map[string]BindMetrics
+	// ReadyDuration is how long it took from the first call to Listen until
+	// all listeners were serving connections.
+	ReadyDuration time.Duration
+}
+
+// StartupMetrics returns how long it took for each listener to become ready,
+// and for the server as a whole to begin serving connections.
+func (s *Server) StartupMetrics() StartupMetrics {
+	s.startupMutex.Lock()
+	defer s.startupMutex.Unlock()
+
+	metrics := StartupMetrics{
+		Binds:         make(map[string]BindMetrics, len(s.startupMetrics.Binds)),
+		ReadyDuration: s.startupMetrics.ReadyDuration,
+	}
+	for addr, bind := range s.startupMetrics.Binds {
+		metrics.Binds[addr] = bind
+	}
+	return metrics
+}
+
+// recordBind records how long it took to begin listening on addr.
+func (s *Server) recordBind(addr string, start time.Time, reused bool) {
+	s.startupMutex.Lock()
+	if s.startupBegan.IsZero() {
+		s.startupBegan = start
+	}
+	if s.startupMetrics.Binds == nil {
+		s.startupMetrics.Binds = make(map[string]BindMetrics)
+	}
+	s.startupMetrics.Binds[addr] = BindMetrics{
+		Duration: time.Since(start),
+		Reused:   reused,
+	}
+	s.startupMutex.Unlock()
+}
+
+// recordReady records that all listeners are serving connections.
+func (s *Server) recordReady() {
+	s.startupMutex.Lock()
+	if !s.startupBegan.IsZero() {
+		s.startupMetrics.ReadyDuration = time.Since(s.startupBegan)
+	}
+	s.startupMutex.Unlock()
 }
 
 // AddTLSCertificate reads the certificate and private key from the provided
 // PEM blocks, and adds the certificate to the list of certificates that the
-// server can use.
+// server can use.  An error is returned if the certificate is expired or not
+// yet valid, unless AllowInvalidCertificates is set.
 func (s *Server) AddTLSCertificate(certPEMBlock, keyPEMBlock []byte) error {
 	cert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
 	if err != nil {
 		return err
 	}
 
-	s.addTLSCert(cert)
-	return nil
+	return s.addTLSCert(cert)
 }
 
 // AddTLSCertificateFromFile reads the certificate and private key from the
 // provided file paths, and adds the certificate to the list of certificates
-// that the server can use.
+// that the server can use.  An error is returned if the certificate is expired
+// or not yet valid, unless AllowInvalidCertificates is set.
 func (s *Server) AddTLSCertificateFromFile(certFile, keyFile string) error {
 	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
 		return err
 	}
 
-	s.addTLSCert(cert)
-	return nil
+	return s.addTLSCert(cert)
 }
 
 // addTLSCert adds the provided certificate to the list of certificates that
-// the server can use.
-func (s *Server) addTLSCert(cert tls.Certificate) {
+// the server can use, after checking that it is currently valid.
+func (s *Server) addTLSCert(cert tls.Certificate) error {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return fmt.Errorf("server: failed to parse certificate: %v", err)
+	}
+	if err = checkValidityPeriod(leaf, time.Now()); err != nil {
+		if !s.AllowInvalidCertificates {
+			return fmt.Errorf("server: %v", err)
+		}
+		s.logf("server: adding certificate anyway: %v", err)
+	}
+
+	s.updateTLS(func(config *tls.Config) {
+		config.Certificates = append(config.Certificates, cert)
+		config.BuildNameToCertificate()
+	})
+	return nil
+}
+
+// CertificateErrors is a file path to error mapping of certificates that could
+// not be added.
+type CertificateErrors map[string]error
+
+// Error implements the Error() method of the error interface.
+func (e CertificateErrors) Error() string {
+	paths := make([]string, 0, len(e))
+	for path := range e {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	msgs := make([]string, len(paths))
+	for i, path := range paths {
+		msgs[i] = path + ": " + e[path].Error()
+	}
+	return "failed to add certificates: " + strings.Join(msgs, "; ")
+}
+
+// AddTLSCertificatesFromDir adds every certificate in the provided directory
+// to the list of certificates that the server can use.  A certificate is read
+// from each name.crt file, with its private key in name.key, and from each
+// fullchain.pem file, with its private key in privkey.pem, in the directory
+// itself or in any of its subdirectories, as laid out by certbot.  A
+// certificate that cannot be added does not prevent the others from being
+// added, and is reported in the CertificateErrors returned.
+func (s *Server) AddTLSCertificatesFromDir(dir string) error {
+	pairs, err := certificatePairs(dir)
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return fmt.Errorf("server: no certificates found in %v", dir)
+	}
+
+	errs := make(CertificateErrors)
+	for _, pair := range pairs {
+		if err = s.AddTLSCertificateFromFile(pair[0], pair[1]); err != nil {
+			errs[pair[0]] = err
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// certificatePairs returns the certificate and private key file paths found in
+// the provided directory, as described by AddTLSCertificatesFromDir.
+func certificatePairs(dir string) ([][2]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var pairs [][2]string
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+			certFile := filepath.Join(dir, name, "fullchain.pem")
+			if _, err := os.Stat(certFile); err == nil {
+				pairs = append(pairs, [2]string{certFile, filepath.Join(dir, name, "privkey.pem")})
+			}
+		case name == "fullchain.pem":
+			pairs = append(pairs, [2]string{filepath.Join(dir, name), filepath.Join(dir, "privkey.pem")})
+		case strings.HasSuffix(name, ".crt"):
+			keyFile := strings.TrimSuffix(name, ".crt") + ".key"
+			pairs = append(pairs, [2]string{filepath.Join(dir, name), filepath.Join(dir, keyFile)})
+		}
+	}
+	return pairs, nil
+}
+
+// ReloadTLSCertificate reads the certificate and private key from the provided
+// file paths, and uses the certificate in place of any existing certificates
+// that cover the same names, or adds it if there are none.  Unlike adding a
+// certificate, this also takes effect on listeners that are already serving TLS
+// connections.  Connections that have already been accepted are unaffected.
+func (s *Server) ReloadTLSCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
 	if s.TLS == nil {
 		s.TLS = s.initialTLSConfiguration()
 	}
-	s.TLS.Certificates = append(s.TLS.Certificates, cert)
+	s.TLS.Certificates = replaceCertificate(s.TLS.Certificates, cert)
+	s.TLS.BuildNameToCertificate()
+	s.listeners.reloadTLS(s.TLS)
+	return nil
+}
+
+// RequireClientCert requires TLS clients to present a certificate signed by one
+// of the certificate authorities in the provided PEM encoded bundle.  Listeners
+// that are already serving TLS connections require one from the next handshake
+// on, so clients that connected earlier are not asked for a certificate.
+// Handlers can find the verified chains in the request's TLS connection state.
+func (s *Server) RequireClientCert(caPEM []byte) error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return errors.New("server: no certificates found in the CA bundle")
+	}
+
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	if s.TLS == nil {
+		s.TLS = s.initialTLSConfiguration()
+	}
+	s.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	s.TLS.ClientCAs = pool
+	s.listeners.reloadTLS(s.TLS)
+	return nil
+}
+
+// RemoveTLSCertificate removes any certificates that cover the provided server
+// name.  They stop being offered in new handshakes immediately, even by
+// listeners that are already serving TLS connections, while connections that
+// were established with them continue undisturbed.  An error is returned if no
+// certificate covers the name, or if removing the certificates would leave
+// listeners that are serving TLS connections without any certificate.
+func (s *Server) RemoveTLSCertificate(serverName string) error {
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	if s.TLS == nil {
+		return fmt.Errorf("server: no certificate for %v", serverName)
+	}
+	remaining := make([]tls.Certificate, 0, len(s.TLS.Certificates))
+	for _, cert := range s.TLS.Certificates {
+		var matches bool
+		for _, name := range certificateNames(cert) {
+			if strings.EqualFold(name, serverName) {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			remaining = append(remaining, cert)
+		}
+	}
+	if len(remaining) == len(s.TLS.Certificates) {
+		return fmt.Errorf("server: no certificate for %v", serverName)
+	}
+	if len(remaining) == 0 && s.TLS.GetCertificate == nil && s.TLS.GetConfigForClient == nil &&
+		s.listeners.servingTLS() {
+		return fmt.Errorf("server: removing the certificate for %v would leave listeners without a certificate", serverName)
+	}
+
+	s.TLS.Certificates = remaining
 	s.TLS.BuildNameToCertificate()
+	s.listeners.reloadTLS(s.TLS)
+	return nil
+}
+
+// CertInfo describes a certificate that the server can use.
+type CertInfo struct {
+	// CommonName is the common name of the certificate's subject.
+	CommonName string
+	// DNSNames are the names that the certificate covers.
+	DNSNames []string
+	// NotBefore and NotAfter bound the period during which the certificate
+	// is valid.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Certificates returns a description of each certificate that the server can
+// use, in the order that they were added.  Certificates that cannot be parsed
+// are skipped.
+func (s *Server) Certificates() []CertInfo {
+	s.tlsMutex.RLock()
+	defer s.tlsMutex.RUnlock()
+
+	if s.TLS == nil {
+		return nil
+	}
+	certs := make([]CertInfo, 0, len(s.TLS.Certificates))
+	for _, cert := range s.TLS.Certificates {
+		leaf, err := leafCertificate(cert)
+		if err != nil {
+			continue
+		}
+		certs = append(certs, CertInfo{
+			CommonName: leaf.Subject.CommonName,
+			DNSNames:   append([]string(nil), leaf.DNSNames...),
+			NotBefore:  leaf.NotBefore,
+			NotAfter:   leaf.NotAfter,
+		})
+	}
+	return certs
+}
+
+// Reconfigure applies fn to a copy of the server's TLS configuration, and
+// then uses the copy in its place, so that several changes, such as to cipher
+// suites, versions, and certificates, take effect together.  Listeners without
+// their own TLS configuration switch to the copy at once, serving or not,
+// although one that is already serving plain HTTP is not switched to TLS.
+// Connections that have already been accepted, including those that are in
+// the middle of a handshake, continue to use the previous configuration.  An
+// error is returned, and nothing changes, if the new configuration would leave
+// listeners that are serving TLS connections without any certificate.
+func (s *Server) Reconfigure(fn func(config *tls.Config)) error {
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	var config *tls.Config
+	if s.TLS == nil {
+		config = s.initialTLSConfiguration()
+	} else {
+		config = s.TLS.Clone()
+	}
+	fn(config)
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil &&
+		s.listeners.servingTLS() {
+		return errors.New("server: the new configuration would leave listeners without a certificate")
+	}
+
+	config.BuildNameToCertificate()
+	s.TLS = config
+	s.listeners.reloadTLS(s.TLS)
+	return nil
+}
+
+// replaceCertificate returns a copy of certs, with any certificates that cover
+// the same names as cert replaced by cert.  If no certificates are replaced,
+// cert is appended.  The provided slice is not modified, as it may be in use by
+// listeners.
+func replaceCertificate(certs []tls.Certificate, cert tls.Certificate) []tls.Certificate {
+	names := make(map[string]bool)
+	for _, name := range certificateNames(cert) {
+		names[name] = true
+	}
+
+	replaced := make([]tls.Certificate, 0, len(certs)+1)
+	var found bool
+	for _, existing := range certs {
+		var overlaps bool
+		for _, name := range certificateNames(existing) {
+			if names[name] {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			replaced = append(replaced, existing)
+		} else if !found {
+			replaced = append(replaced, cert)
+			found = true
+		}
+	}
+	if !found {
+		replaced = append(replaced, cert)
+	}
+	return replaced
+}
+
+// certificateNames returns the common name, DNS names, and IP addresses that
+// the provided certificate covers.
+func certificateNames(cert tls.Certificate) []string {
+	leaf, err := leafCertificate(cert)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+	names = append(names, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// leafCertificate returns the parsed leaf of the provided certificate.
+func leafCertificate(cert tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("empty certificate")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// SetTLSVersions sets the minimum and maximum TLS versions that the server
+// will accept.  A max of zero means the maximum version supported by the
+// crypto/tls package.
+func (s *Server) SetTLSVersions(min, max uint16) {
+	s.updateTLS(func(config *tls.Config) {
+		config.MinVersion = min
+		config.MaxVersion = max
+	})
+}
+
+// SetCurvePreferences sets the elliptic curves that the server will use for
+// ECDHE key exchange, in order of preference.  Clients that support none of
+// them are unable to connect.  Without any curves, X25519, P-256, and P-384
+// are used.
+func (s *Server) SetCurvePreferences(curves ...tls.CurveID) {
+	if len(curves) == 0 {
+		curves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	}
+	s.updateTLS(func(config *tls.Config) {
+		config.CurvePreferences = append([]tls.CurveID(nil), curves...)
+	})
+}
+
+// SetRenegotiation sets the TLS renegotiation policy of the server's TLS
+// configuration, for current and future listeners.  The crypto/tls package
+// never allows clients to renegotiate with a server, so, like
+// TLSClientSessionCache, this only affects connections where the server's
+// configuration is used to act as a TLS client, such as when proxying to
+// legacy upstreams that require renegotiation.  Renegotiation allows the
+// peer to change the parameters of the connection, including its
+// certificate, partway through, and has been the basis of attacks such as
+// the injection of data at the start of a connection (CVE-2009-3555) and the
+// triple handshake attack.  It should only be enabled for upstreams that
+// require it, and tls.RenegotiateOnceAsClient is preferable to
+// tls.RenegotiateFreelyAsClient.  The default is tls.RenegotiateNever.
+func (s *Server) SetRenegotiation(r tls.RenegotiationSupport) {
+	s.updateTLS(func(config *tls.Config) {
+		config.Renegotiation = r
+	})
+}
+
+// SetNextProtos replaces the protocols that the server offers, in order of
+// preference, for negotiation via ALPN.  This replaces any protocols added by
+// EnableHTTP2 or EnableAutocert, so they must be included if still wanted.
+// Protocols other than "h2" and "http/1.1" are negotiated, but are served as
+// HTTP/1.1 unless handled by the listener's http.Server.
+func (s *Server) SetNextProtos(protos ...string) {
+	s.updateTLS(func(config *tls.Config) {
+		config.NextProtos = append([]string(nil), protos...)
+	})
+}
+
+// SetConfigForClient selects the TLS configuration for each connection, based
+// on its ClientHello, as with tls.Config's GetConfigForClient.  This allows,
+// for example, different cipher suites for each server name, or rejecting
+// unknown server names by returning an error.  If fn returns a nil
+// configuration, the server's configuration is used.  If the configuration it
+// returns has no certificates of its own, it uses the server's certificates.
+// fn is consulted for every handshake after this returns, including those on
+// listeners that are already serving TLS connections.  A nil fn removes the
+// function.
+func (s *Server) SetConfigForClient(fn func(*tls.ClientHelloInfo) (*tls.Config, error)) {
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	if s.TLS == nil {
+		s.TLS = s.initialTLSConfiguration()
+	}
+	if fn == nil {
+		s.TLS.GetConfigForClient = nil
+	} else {
+		s.TLS.GetConfigForClient = s.configForClient(fn)
+	}
+	s.listeners.reloadTLS(s.TLS)
+}
+
+// configForClient wraps fn so that the configurations it returns without any
+// certificates use the server's certificates.
+func (s *Server) configForClient(fn func(*tls.ClientHelloInfo) (*tls.Config, error)) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := fn(hello)
+		if err != nil || config == nil {
+			return config, err
+		}
+		if len(config.Certificates) > 0 || config.GetCertificate != nil {
+			return config, nil
+		}
+
+		// The certificates are read when the handshake happens, so that
+		// certificates added or reloaded since are used.
+		config = config.Clone()
+		s.tlsMutex.RLock()
+		config.Certificates = s.TLS.Certificates
+		config.GetCertificate = s.TLS.GetCertificate
+		s.tlsMutex.RUnlock()
+		config.BuildNameToCertificate()
+		return config, nil
+	}
+}
+
+// EnableHTTP2 allows HTTP/2 to be negotiated, via ALPN, on TLS connections.
+// HTTP/2 is preferred over HTTP/1.1 for clients that support both.  Listeners
+// with their own TLS configuration must include "h2" in their NextProtos
+// instead.
+func (s *Server) EnableHTTP2() {
+	s.updateTLS(func(config *tls.Config) {
+		for _, proto := range config.NextProtos {
+			if proto == "h2" {
+				return
+			}
+		}
+		config.NextProtos = append([]string{"h2"}, config.NextProtos...)
+	})
+}
+
+// EnableH2C allows HTTP/2 to be used without TLS, on listeners that are not
+// serving TLS connections.  This is intended for environments, such as service
+// meshes, where connections are secured by other means.  Clients may use
+// HTTP/2 with prior knowledge, or upgrade to it from HTTP/1.1 with an
+// "Upgrade: h2c" request.  It applies to listeners that begin serving
+// afterwards.
+func (s *Server) EnableH2C() {
+	s.middlewareMutex.Lock()
+	s.h2c = true
+	s.middlewareMutex.Unlock()
+}
+
+// h2cEnabled returns true if HTTP/2 is allowed without TLS.
+func (s *Server) h2cEnabled() bool {
+	s.middlewareMutex.RLock()
+	defer s.middlewareMutex.RUnlock()
+	return s.h2c
+}
+
+// ConfigureHTTPServer calls fn with the http.Server of each listener, once it
+// has been configured by the server and before it begins serving connections,
+// so that fields the server does not expose, such as
+// DisableGeneralOptionsHandler, may be set.  The server relies on Handler and
+// ConnState, which must not be replaced; set ConnState on the Server instead.
+// A BaseContext or ConnContext set by fn is extended, rather than replaced, by
+// the server's own.  It applies to listeners that begin serving afterwards,
+// and a nil fn removes it.
+func (s *Server) ConfigureHTTPServer(fn func(*http.Server)) {
+	s.middlewareMutex.Lock()
+	s.httpConfig = fn
+	s.middlewareMutex.Unlock()
+}
+
+// httpServerConfig returns the function set by ConfigureHTTPServer, if any.
+func (s *Server) httpServerConfig() func(*http.Server) {
+	s.middlewareMutex.RLock()
+	defer s.middlewareMutex.RUnlock()
+	return s.httpConfig
+}
+
+// EnableAutocert obtains certificates on demand, during the TLS handshake,
+// from the provided autocert manager, and allows the tls-alpn-01 challenge to
+// be negotiated.  Certificates from the manager take precedence over those
+// added to the server.
+func (s *Server) EnableAutocert(m *autocert.Manager) {
+	s.updateTLS(func(config *tls.Config) {
+		config.GetCertificate = m.GetCertificate
+		for _, proto := range config.NextProtos {
+			if proto == acme.ALPNProto {
+				return
+			}
+		}
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+	})
+}
+
+// updateTLS applies the provided function to the server's TLS configuration,
+// creating it if necessary, and then reconfigures the listeners with the
+// result.
+func (s *Server) updateTLS(fn func(config *tls.Config)) {
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	if s.TLS == nil {
+		s.TLS = s.initialTLSConfiguration()
+	}
+	fn(s.TLS)
 	s.listeners.configureTLS(s.TLS)
 }
 
@@ -123,6 +1154,7 @@ func (s *Server) initialTLSConfiguration() *tls.Config {
 	return &tls.Config{
 		Certificates: []tls.Certificate{},
 		NextProtos:   []string{"http/1.1"},
+		MinVersion:   tls.VersionTLS12,
 		// Reasoning behind the cipher suite ordering:
 		//
 		// - Forward secrecy is first priority. ECDHE beats DHE on strength
@@ -173,36 +1205,691 @@ func (s *Server) initialTLSConfiguration() *tls.Config {
 		},
 		PreferServerCipherSuites: true,  // Prefer our strong ciphers
 		SessionTicketsDisabled:   false, // Support session tickets
+		ClientSessionCache:       s.TLSClientSessionCache,
 	}
 }
 
-// Serve begins serving connections.
-func (s *Server) Serve() {
-	s.listeners.serve(s)
+// Serve begins serving connections.  It does not block.  If any listener is
+// unable to begin serving connections, it is closed and a ServeErrors is
+// returned describing the failures.  Listeners that were able to begin serving
+// connections continue to do so.
+func (s *Server) Serve() error {
+	atomic.StoreInt32(&s.draining, 0)
+	s.listeners.limitConns(s.MaxConnections)
+	err := s.listeners.serve(s)
+	s.recordReady()
+	return err
+}
+
+// ServeUntilSignal begins serving connections, blocks until one of the provided
+// signals is received, and then gracefully shuts down the server.  Without any
+// signals, it waits for SIGINT or SIGTERM.  Any error from Serve is returned
+// once the server has shut down, or immediately if no listener was able to
+// begin serving connections.
+func (s *Server) ServeUntilSignal(sigs ...os.Signal) error {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, sigs...)
+	defer signal.Stop(received)
+
+	err := s.Serve()
+	if err != nil && len(s.Addrs()) == 0 {
+		return err
+	}
+	<-received
+	s.Shutdown()
+	return err
+}
+
+// ServeConn serves the provided connection, which has already been accepted,
+// and blocks until it is closed.  The connection is served in the same way as
+// one accepted by a listener, using the server's TLS configuration if it has
+// one, and is accounted for when the server shuts down.
+func (s *Server) ServeConn(c net.Conn) {
+	var config *tls.Config
+	s.tlsMutex.RLock()
+	if s.TLS != nil {
+		config = s.TLS.Clone()
+	}
+	s.tlsMutex.RUnlock()
+
+	s.listeners.serveConn(s, c, config)
 }
 
 // Shutdown gracefully shuts down the server, allowing any currently active
-// connections to finish before doing so.
+// connections to finish before doing so.  Once they have, any registered
+// barriers are drained.
 func (s *Server) Shutdown() {
-	s.listeners.shutdown(true)
+	s.beforeShutdown()
+	s.shutdown(func() {
+		s.listeners.shutdown(true)
+		if err := s.drainBarriers(context.Background()); err != nil {
+			s.logf("server: failed to drain barrier: %v", err)
+		}
+	})
+}
+
+// ShutdownWithTimeout gracefully shuts down the server, allowing any currently
+// active connections up to the provided timeout to finish.  It proceeds as soon
+// as they have finished, rather than waiting out the timeout.  Once the timeout
+// expires, any remaining connections are forcefully closed and a
+// *ShutdownTimeoutError is returned.  Registered barriers are drained within
+// whatever remains of the timeout, and the first error from draining them is
+// returned.
+func (s *Server) ShutdownWithTimeout(timeout time.Duration) error {
+	s.beforeShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var abandoned int
+	var expired bool
+	var err error
+	s.shutdown(func() {
+		abandoned, expired = s.listeners.shutdownWithTimeout(timeout)
+		err = s.drainBarriers(ctx)
+	})
+	if expired {
+		return &ShutdownTimeoutError{Abandoned: abandoned}
+	}
+	return err
+}
+
+// ShutdownContext gracefully shuts down the server, allowing any currently
+// active connections to finish before doing so.  Listeners stop accepting new
+// connections immediately.  If the context is done before all connections have
+// finished, the context's error is returned.  Otherwise, registered barriers
+// are drained with the context, and the first error from draining them is
+// returned.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	s.beforeShutdown()
+	var err error
+	s.shutdown(func() {
+		if err = s.listeners.shutdownContext(ctx); err == nil {
+			err = s.drainBarriers(ctx)
+		}
+	})
+	return err
+}
+
+// ShutdownErrors maps the positions of servers passed to ShutdownAll to the
+// errors returned when shutting them down.
+type ShutdownErrors map[int]error
+
+// Error implements the Error() method of the error interface.
+func (e ShutdownErrors) Error() string {
+	indexes := make([]int, 0, len(e))
+	for i := range e {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]string, len(indexes))
+	for i, index := range indexes {
+		msgs[i] = fmt.Sprintf("server %d: %v", index, e[index])
+	}
+	return "failed to shut down: " + strings.Join(msgs, "; ")
+}
+
+// ShutdownAll gracefully shuts down each of the provided servers, in order,
+// with ShutdownContext, so that each server finishes shutting down before the
+// next begins.  The context bounds the shutdown of all of them; once it is
+// done, the remaining servers stop accepting connections without waiting for
+// their connections to finish.  Any errors are returned as a ShutdownErrors.
+func ShutdownAll(ctx context.Context, servers ...*Server) error {
+	errs := make(ShutdownErrors)
+	for i, s := range servers {
+		if err := s.ShutdownContext(ctx); err != nil {
+			errs[i] = err
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// requestContext returns the context that the contexts of requests are derived
+// from.  It is canceled when the server begins shutting down, if
+// CancelRequestsOnShutdown is set.
+func (s *Server) requestContext() context.Context {
+	if !s.CancelRequestsOnShutdown {
+		return context.Background()
+	}
+
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	if s.requestsCtx == nil {
+		s.requestsCtx, s.cancelRequests = context.WithCancelCause(context.Background())
+	}
+	return s.requestsCtx
+}
+
+// cancelRequestContexts cancels the contexts of the requests being served.
+// Listeners that begin serving afterwards receive a new context.
+func (s *Server) cancelRequestContexts() {
+	s.requestsMutex.Lock()
+	defer s.requestsMutex.Unlock()
+
+	if s.cancelRequests != nil {
+		s.cancelRequests(ErrShuttingDown)
+		s.requestsCtx, s.cancelRequests = nil, nil
+	}
+}
+
+// beforeShutdown records that the server is shutting down, and calls the
+// BeforeShutdown hook, if it is set.
+func (s *Server) beforeShutdown() {
+	atomic.StoreInt32(&s.draining, 1)
+	if s.BeforeShutdown != nil {
+		s.BeforeShutdown()
+	}
+}
+
+// ShutdownDependency declares that the listener for addr depends on the
+// listeners for dependsOn.  During a graceful shutdown, the listener for addr is
+// closed, and its active requests allowed to finish, before the listeners it
+// depends on are closed.  An error is returned if the dependency would create a
+// cycle.
+func (s *Server) ShutdownDependency(addr string, dependsOn ...string) error {
+	return s.listeners.addDependencies(addr, dependsOn...)
+}
+
+// Wait blocks until all listeners have been shut down, and all of their
+// connections closed, without shutting them down itself.  It returns
+// immediately if there are no listeners.
+func (s *Server) Wait() {
+	s.listeners.Wait()
+}
+
+// StopAccepting closes all listeners, so that no new connections are
+// accepted, while connections that have already been accepted, including idle
+// keep-alive connections, keep being served for as long as their clients keep
+// them open.  It does not wait for anything.  Once a later Shutdown, or any of
+// its variants, is called, those connections are shut down as usual.
+// Listening on the same addresses again is possible once this returns.
+func (s *Server) StopAccepting() {
+	s.listeners.stopAccepting()
 }
 
-// ForceShutdown forcefully closes all currently active connections.  Little
-// care is shown in making sure things are cleaned up, so this should generally
-// only be used as a last resort.
+// ForceShutdown closes all listeners, and forcefully closes all currently
+// active connections, without waiting for the requests being served on them to
+// finish.  Little care is shown in making sure things are cleaned up, so this
+// should generally only be used as a last resort.  Registered barriers are not
+// drained.
 func (s *Server) ForceShutdown() {
-	s.listeners.shutdown(false)
+	s.shutdown(func() {
+		s.listeners.shutdown(false)
+	})
 }
 
-// Detach returns an address to file descriptor mapping for all listeners.
+// Barrier is work started by the server, other than HTTP requests, that must
+// finish before a graceful shutdown completes.  A typical example is a queue
+// of background jobs enqueued by handlers.
+type Barrier interface {
+	// Drain stops accepting new work, and blocks until outstanding work has
+	// finished or the context is done.
+	Drain(ctx context.Context) error
+}
+
+// AddBarrier registers a barrier to be drained during a graceful shutdown.
+// Barriers are drained in the order they were registered, once all active
+// requests have finished.
+func (s *Server) AddBarrier(b Barrier) {
+	s.barriersMutex.Lock()
+	defer s.barriersMutex.Unlock()
+	s.barriers = append(s.barriers, b)
+}
+
+// drainBarriers drains the registered barriers in order, returning the first
+// error encountered.  Every barrier is drained even if an earlier one fails.
+func (s *Server) drainBarriers(ctx context.Context) error {
+	s.barriersMutex.Lock()
+	barriers := s.barriers
+	s.barriersMutex.Unlock()
+
+	var firstErr error
+	for _, b := range barriers {
+		if err := b.Drain(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// shutdown shuts down the server using the provided drain function, notifying
+// the shutdown webhook (if any) when shutdown begins and completes.
+func (s *Server) shutdown(drain func()) {
+	// The server stays draining once shut down, so that it is not reported as
+	// ready again until it begins serving again.
+	atomic.StoreInt32(&s.draining, 1)
+	s.stopRefreshingOCSP()
+	s.stopRotatingSessionTicketKeys()
+	s.stopCertExpiryWarning()
+	start := time.Now()
+	s.eventf("server: shutdown started with %d active requests", s.ActiveRequests())
+	s.notifyShutdown("shutdown_started", 0)
+	s.cancelRequestContexts()
+	stopProgress := s.reportDrainProgress()
+	drain()
+	stopProgress()
+	s.eventf("server: shutdown completed in %v", time.Since(start))
+	s.notifyShutdown("shutdown_completed", time.Since(start))
+}
+
+// drainProgressInterval is how often OnDrainProgress is called while the
+// server is shutting down.
+const drainProgressInterval = time.Second
+
+// reportDrainProgress calls OnDrainProgress, if it is set, with the number of
+// requests being served and connections open, immediately and then on an
+// interval, until the returned function is called.
+func (s *Server) reportDrainProgress() func() {
+	if s.OnDrainProgress == nil {
+		return func() {}
+	}
+
+	report := func() {
+		requests, connections := s.ActiveRequests(), s.listeners.connCount()
+		if requests > 0 || connections > 0 {
+			s.OnDrainProgress(requests, connections)
+		}
+	}
+	report()
+	stop, done := make(chan struct{}), make(chan struct{})
+	s.listeners.spawn(func() {
+		defer close(done)
+		ticker := time.NewTicker(drainProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-stop:
+				return
+			}
+		}
+	})
+	// Stopping waits for a report in progress, so that none are made once
+	// the shutdown has completed.
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// ShutdownTimeoutError is returned by ShutdownWithTimeout when connections did
+// not finish before the timeout expired.
+type ShutdownTimeoutError struct {
+	// Abandoned is the number of connections that were forcefully closed.
+	Abandoned int
+}
+
+// Error implements the Error() method of the error interface.
+func (e *ShutdownTimeoutError) Error() string {
+	return fmt.Sprintf("shutdown timed out, abandoned %d connections", e.Abandoned)
+}
+
+// ShutdownWebhook sets a URL that will be sent a JSON event, via a POST
+// request, when the server begins and finishes shutting down.  Delivery is
+// best effort, and failures are logged rather than returned.
+func (s *Server) ShutdownWebhook(url string) {
+	s.shutdownWebhook = url
+}
+
+// shutdownWebhookTimeout is how long a single shutdown webhook request is
+// allowed to take.
+const shutdownWebhookTimeout = 5 * time.Second
+
+// shutdownEvent is the payload sent to the shutdown webhook.
+type shutdownEvent struct {
+	Event           string `json:"event"`
+	ActiveRequests  int64  `json:"active_requests"`
+	DrainDurationMS int64  `json:"drain_duration_ms"`
+}
+
+// notifyShutdown asynchronously sends a shutdown event to the shutdown
+// webhook, if one has been set.
+func (s *Server) notifyShutdown(event string, drainDuration time.Duration) {
+	url := s.shutdownWebhook
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(&shutdownEvent{
+		Event:           event,
+		ActiveRequests:  atomic.LoadInt64(&s.listeners.activeRequests),
+		DrainDurationMS: int64(drainDuration / time.Millisecond),
+	})
+	if err != nil {
+		s.logf("server: failed to encode shutdown event: %v", err)
+		return
+	}
+
+	s.listeners.spawn(func() {
+		client := &http.Client{Timeout: shutdownWebhookTimeout}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			s.logf("server: failed to send shutdown event to %v: %v", url, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			s.logf("server: shutdown webhook %v responded with status %v", url, resp.StatusCode)
+		}
+	})
+}
+
+// Addrs returns the addresses of all listeners that are not closing.
+func (s *Server) Addrs() []net.Addr {
+	return s.listeners.addrs()
+}
+
+// SetMaxConns limits the number of connections that each listener, current
+// and future, may have active at once.  Once a listener reaches the limit, it
+// stops accepting connections until one of its active connections closes, and
+// new connections wait in the operating system's backlog.  This is in addition
+// to MaxConnections, which limits connections across all listeners.  A limit
+// of zero or less removes the limit.
+func (s *Server) SetMaxConns(n int) {
+	s.listeners.setMaxConnsPerListener(n)
+}
+
+// ActiveRequests returns the number of requests that are currently being
+// served.
+func (s *Server) ActiveRequests() int {
+	return int(atomic.LoadInt64(&s.listeners.activeRequests))
+}
+
+// Detach returns an address to file descriptor mapping for all listeners.  The
+// descriptors are duplicates, which remain valid after the server shuts down,
+// and are closed by the server that reuses them.
 func (s *Server) Detach() DetachedListeners {
 	return s.listeners.detach()
 }
 
+// StopDetached shuts down the listeners that have been detached, once the
+// server that reuses them is accepting connections, while any other listeners
+// keep serving.  If graceful, it blocks until the requests being served by the
+// detached listeners have finished, otherwise their connections are
+// forcefully closed.
+func (s *Server) StopDetached(graceful bool) {
+	s.listeners.stopDetached(graceful)
+}
+
+// defaultShutdownRetryAfter is the Retry-After sent while draining, if
+// ShutdownRetryAfter is not set.
+const defaultShutdownRetryAfter = 5 * time.Second
+
+// listenerErrorsBuffer is the number of errors that the channel returned by
+// Errors holds before further errors are dropped.
+const listenerErrorsBuffer = 16
+
+// ListenerError is an error that caused a listener to stop serving
+// connections.
+type ListenerError struct {
+	// Addr is the address of the listener.
+	Addr string
+	// Err is the error that caused it to stop.
+	Err error
+}
+
+// Error implements the Error() method of the error interface.
+func (e ListenerError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Addr, e.Err)
+}
+
+// Unwrap returns the error that caused the listener to stop.
+func (e ListenerError) Unwrap() error {
+	return e.Err
+}
+
+// Errors returns a channel that receives an error whenever a listener stops
+// serving connections due to an error, in addition to the error being handled
+// by ErrorHandler or logged.  Every call returns the same channel, which is
+// buffered, and never closed.  Errors that arrive while the buffer is full are
+// dropped, and logged instead, so the channel should be read promptly.  Only
+// errors that occur after the first call are sent.
+func (s *Server) Errors() <-chan ListenerError {
+	s.errorsMutex.Lock()
+	defer s.errorsMutex.Unlock()
+
+	if s.listenerErrors == nil {
+		s.listenerErrors = make(chan ListenerError, listenerErrorsBuffer)
+	}
+	return s.listenerErrors
+}
+
+// serveError handles an error that caused the listener for addr to stop
+// serving connections.
+func (s *Server) serveError(addr string, err error) {
+	s.errorsMutex.Lock()
+	if s.listenerErrors != nil {
+		select {
+		case s.listenerErrors <- ListenerError{Addr: addr, Err: err}:
+		default:
+			s.logf("server: dropped error for %v, as the errors channel is full: %v", addr, err)
+		}
+	}
+	s.errorsMutex.Unlock()
+
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(addr, err)
+		return
+	}
+	s.logf("server: failed to serve connections on %v: %v", addr, err)
+}
+
+// logf writes a formatted message to the server's Logger, or its ErrorWriter if
+// there is no Logger.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+		return
+	}
+	w := s.ErrorWriter
+	if w == nil {
+		w = os.Stderr
+	}
+	fmt.Fprintf(w, format+"\n", v...)
+}
+
+// eventf writes a formatted informational message to the server's Logger, if
+// there is one.
+func (s *Server) eventf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// errorLog returns the logger that each listener's http.Server should log
+// errors to.  If nil, the net/http package logs to the standard logger.
+func (s *Server) errorLog() *log.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	if s.ErrorWriter != nil {
+		return log.New(s.ErrorWriter, "", log.LstdFlags)
+	}
+	return nil
+}
+
 // ServeHTTP implements the ServeHTTP() method of the http.Handler interface.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.listeners.Add(1)
-	defer s.listeners.Done()
+	atomic.AddInt64(&s.listeners.activeRequests, 1)
+	defer func() {
+		atomic.AddInt64(&s.listeners.activeRequests, -1)
+		atomic.AddInt64(&s.listeners.servedRequests, 1)
+		s.listeners.Done()
+	}()
+	l, ok := r.Context().Value(listenerContextKey{}).(*listener)
+	if ok {
+		l.beginRequest()
+		defer l.endRequest()
+	}
+
+	// Requests that arrive once their listener has begun shutting down, such
+	// as on a connection that was already reading one, are turned away
+	// politely.
+	if ok && l.hasState(stateClosing) {
+		retryAfter := s.ShutdownRetryAfter
+		if retryAfter <= 0 {
+			retryAfter = defaultShutdownRetryAfter
+		}
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if ok && r.TLS != nil && r.TLS.ServerName != "" && s.SNIMismatchPolicy == SNIMismatchReject &&
+		!l.hasCertificateFor(r.TLS.ServerName) {
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
 
-	s.ServeMux.ServeHTTP(w, r)
+	if s.PanicHandler != nil {
+		defer func() {
+			// ErrAbortHandler is used to deliberately abort a response, and
+			// is not a failure.
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				s.PanicHandler(w, r, recovered)
+			}
+		}()
+	}
+
+	s.middlewareMutex.RLock()
+	maxBodySize, trustedProxies := s.maxBodySize, s.trustedProxies
+	s.middlewareMutex.RUnlock()
+	if maxBodySize > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+	if len(trustedProxies) > 0 {
+		if addr, ok := forwardedFor(r, trustedProxies); ok {
+			r.RemoteAddr = addr
+		}
+	}
+
+	if ok {
+		if handler := l.ownHandler(); handler != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	s.middlewareMutex.RLock()
+	handler, timeout, message := s.handler, s.handlerTimeout, s.timeoutMessage
+	if handler == nil {
+		handler = s.rootHandler
+	}
+	s.middlewareMutex.RUnlock()
+	if handler == nil {
+		handler = s.ServeMux
+	}
+	if timeout > 0 {
+		handler = http.TimeoutHandler(handler, timeout, message)
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// SetHandlerTimeout limits how long the ServeMux, or the handler set by
+// SetHandler, and any middleware, may take to handle a request.  Requests that
+// take longer receive a 503 Service Unavailable response with msg as the body,
+// and the context of the request is canceled.  Unlike ReadTimeout and
+// WriteTimeout, this bounds the time spent in handlers, rather than on the
+// connection.  A duration of zero or less removes the limit.
+func (s *Server) SetHandlerTimeout(d time.Duration, msg string) {
+	s.middlewareMutex.Lock()
+	s.handlerTimeout, s.timeoutMessage = d, msg
+	s.middlewareMutex.Unlock()
+}
+
+// SetMaxBodySize limits the size of the body of every request to n bytes.
+// Reading past the limit returns an *http.MaxBytesError, and the connection is
+// closed once the response has been written; handlers should respond with a
+// 413 Request Entity Too Large.  A size of zero or less removes the limit.
+func (s *Server) SetMaxBodySize(n int64) {
+	s.middlewareMutex.Lock()
+	s.maxBodySize = n
+	s.middlewareMutex.Unlock()
+}
+
+// SetHandler dispatches every request to the provided handler, such as a
+// router from another package, instead of the ServeMux.  Requests still pass
+// through any middleware, and are accounted for, like any other request the
+// server serves.  A nil handler restores dispatching to the ServeMux.
+func (s *Server) SetHandler(h http.Handler) {
+	s.middlewareMutex.Lock()
+	s.rootHandler = h
+	s.middlewareMutex.Unlock()
+}
+
+// baseHandler returns the handler that requests are dispatched to once they
+// have passed through any middleware.
+func (s *Server) baseHandler() http.Handler {
+	s.middlewareMutex.RLock()
+	defer s.middlewareMutex.RUnlock()
+
+	if s.rootHandler != nil {
+		return s.rootHandler
+	}
+	return s.ServeMux
+}
+
+// Handle registers the handler for the given pattern with the server's
+// ServeMux.  Requests for it pass through any middleware, and are accounted
+// for, like any other request the server serves.  It has the same signature as
+// the ServeMux's own method, which it takes the place of.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.routesMutex.Lock()
+	defer s.routesMutex.Unlock()
+
+	s.ServeMux.Handle(pattern, handler)
+	s.routes = append(s.routes, route{pattern, handler})
+}
+
+// HandleFunc registers the handler function for the given pattern with the
+// server's ServeMux, in the same way as Handle.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	if handler == nil {
+		panic("server: nil handler")
+	}
+	s.Handle(pattern, http.HandlerFunc(handler))
+}
+
+// route is a pattern and handler registered with Handle, which Clone registers
+// again with the clone's ServeMux.
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+// Use registers middleware that wraps the dispatch of every request to the
+// ServeMux, or the handler set by SetHandler.  Middleware runs in the order it
+// was registered, so the first middleware registered sees each request first.
+func (s *Server) Use(mw func(http.Handler) http.Handler) {
+	s.middlewareMutex.Lock()
+	defer s.middlewareMutex.Unlock()
+
+	s.middleware = append(s.middleware, mw)
+	s.buildHandler()
+}
+
+// buildHandler wraps the handler that requests are dispatched to in the
+// middleware.  The caller must hold the middleware mutex for writing.
+func (s *Server) buildHandler() {
+	// The handler is looked up for each request, so that it may still be
+	// replaced.
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.baseHandler().ServeHTTP(w, r)
+	})
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+	s.handler = handler
 }
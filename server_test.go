@@ -5,13 +5,32 @@
 package server
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 // Server configuration.
@@ -62,8 +81,8 @@ func init() {
 
 func testServer() *Server {
 	server := New()
-	server.ServeMux.HandleFunc(simpleRoute, simpleHandler)
-	server.ServeMux.HandleFunc(longRunningRoute, longRunningHandler)
+	server.HandleFunc(simpleRoute, simpleHandler)
+	server.HandleFunc(longRunningRoute, longRunningHandler)
 	return server
 }
 
@@ -171,9 +190,267 @@ func TestServerHTTPS(t *testing.T) {
 	}
 }
 
+func TestSetListenConfig(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	var controlled []string
+	server.SetListenConfig(net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			controlled = append(controlled, address)
+			return nil
+		},
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the Control function was called for the listener, and that
+	// it serves connections.
+	if len(controlled) != 1 || controlled[0] != addrs[0] {
+		t.Errorf("Expected the Control function to be called for %v, received '%v'.", addrs[0], controlled)
+	}
+	if err := rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	server := testServer()
+	server.ReadTimeout = 5 * time.Second
+	server.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "true")
+			next.ServeHTTP(w, r)
+		})
+	})
+	if err := server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	clone := server.Clone()
+
+	// Ensure that the configuration was copied.
+	if clone.ReadTimeout != server.ReadTimeout {
+		t.Errorf("Expected a read timeout of %v, received '%v'.", server.ReadTimeout, clone.ReadTimeout)
+	}
+	if len(clone.TLS.Certificates) != 1 {
+		t.Fatalf("Expected 1 certificate, found %v.", len(clone.TLS.Certificates))
+	}
+	recorder := httptest.NewRecorder()
+	clone.ServeHTTP(recorder, httptest.NewRequest("GET", simpleRoute, nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("X-Middleware") != "true" {
+		t.Errorf("Expected the request to pass through the middleware, received '%v' '%v'.",
+			recorder.Code, recorder.Header())
+	}
+
+	// Ensure that changes to the clone do not affect the original.
+	if err := clone.AddTLSCertificateFromFile("./test/srv2.localhost.crt", "./test/srv2.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	clone.SetTLSVersions(tls.VersionTLS13, 0)
+	clone.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Clone", "true")
+			next.ServeHTTP(w, r)
+		})
+	})
+	if len(server.TLS.Certificates) != 1 {
+		t.Errorf("Expected the original to have 1 certificate, found %v.", len(server.TLS.Certificates))
+	}
+	if server.TLS.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected the original minimum version to be unchanged, received '%v'.", server.TLS.MinVersion)
+	}
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", simpleRoute, nil))
+	if recorder.Header().Get("X-Clone") != "" {
+		t.Error("Expected the original to not use the clone's middleware.")
+	}
+	clone.HandleFunc("/clone", simpleHandler)
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "/clone", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected the original to not serve the clone's handler, received '%v'.", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	clone.ServeHTTP(recorder, httptest.NewRequest("GET", "/clone", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the clone to serve its handler, received '%v'.", recorder.Code)
+	}
+	if len(clone.listeners.listeners) != 0 {
+		t.Errorf("Expected the clone to have no listeners, found %v.", len(clone.listeners.listeners))
+	}
+}
+
+func TestAcceptTemporaryError(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	logs := &lockedBuffer{}
+	server.ErrorWriter = logs
+	var flaky *flakyListener
+	server.ListenFunc = func(network, addr string) (net.Listener, error) {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		flaky = &flakyListener{Listener: l, failures: 3}
+		return flaky, nil
+	}
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the temporary errors are retried, and that the listener
+	// recovers and serves connections.
+	if err := rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+	if failures := flaky.remaining(); failures != 0 {
+		t.Errorf("Expected all temporary errors to be returned, %v remain.", failures)
+	}
+	if count := strings.Count(logs.String(), "retrying in"); count != 3 {
+		t.Errorf("Expected 3 retries to be logged, received '%v'.", logs.String())
+	}
+	if !server.listeners.listeners[0].hasState(stateServing) {
+		t.Error("Expected the listener to still be serving.")
+	}
+}
+
 func TestGracefulShutdown(t *testing.T) {
-	// FIXME: I can very easily manually test this, but I can't for the life
-	// of me find a way to successfully test it here.
+	server := testServer()
+	pipe := newPipeListener()
+	server.ListenFunc = pipe.listen
+	if err := server.Listen("pipe"); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start a long running request.
+	result := make(chan error, 1)
+	go func() {
+		c, err := pipe.dial()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer c.Close()
+		result <- connRequest(c, longRunningRoute)
+	}()
+	time.Sleep(250 * time.Millisecond)
+
+	// Ensure that shutting down waits for the request to finish.
+	server.Shutdown()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("Expected shutdown to wait for the active request to finish.")
+	}
+}
+
+func TestGracefulShutdownKeepAlive(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	release := make(chan struct{})
+	server.ServeMux.HandleFunc("/block", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintln(w, "Success")
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Open an idle keep-alive connection, and one with a request in flight.
+	idle, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer idle.Close()
+	fmt.Fprintf(idle, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", simpleRoute, addrs[0])
+	idleReader := bufio.NewReader(idle)
+	resp, err := http.ReadResponse(idleReader, nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	active, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer active.Close()
+	fmt.Fprintf(active, "GET /block HTTP/1.1\r\nHost: %v\r\n\r\n", addrs[0])
+	for i := 0; i < 100 && server.ActiveRequests() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ensure that shutting down waits for the connection with a request in
+	// flight, but not for the idle connection.
+	shutdown := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(shutdown)
+	}()
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = idleReader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the idle connection to be closed, received '%v'.", err)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("Expected shutdown to wait for the in-flight request.")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	// Ensure that the in-flight request finishes, and that its connection is
+	// then closed, allowing shutdown to complete.
+	close(release)
+	activeReader := bufio.NewReader(active)
+	resp, err = http.ReadResponse(activeReader, nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200, received '%v'.", resp.StatusCode)
+	}
+	if !resp.Close {
+		t.Error("Expected the response to ask the client to close the connection.")
+	}
+	select {
+	case <-shutdown:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected shutdown to complete once the connection closed.")
+	}
+	active.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = activeReader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, received '%v'.", err)
+	}
+}
+
+func TestListenTwice(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+
+	// Ensure that listening again on the same address is refused.
+	err := server.Listen(addrs[0])
+	if !errors.Is(err, ErrAlreadyListening) {
+		t.Fatalf("Expected ErrAlreadyListening, received '%v'.", err)
+	}
+	if len(server.listeners.listeners) != 1 {
+		t.Errorf("Expected one managed listener, received '%v'.", len(server.listeners.listeners))
+	}
 }
 
 func TestReuseListeners(t *testing.T) {
@@ -246,6 +523,3024 @@ func TestReuseListeners(t *testing.T) {
 	}
 }
 
+func TestStopDetached(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	detachedListeners := server.Detach()
+	if err = server.Listen(addrs[1]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Hand the detached listener off to another server.
+	newServer := New()
+	defer newServer.Shutdown()
+	newServer.HandleFunc("/new", simpleHandler)
+	newServer.ReuseListeners(detachedListeners)
+	if err = newServer.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	newServer.Serve()
+
+	// Ensure that only the detached listener is stopped.
+	server.StopDetached(true)
+	if err = rawRequest(addrs[0], "/new"); err != nil {
+		t.Errorf("Expected the new server to serve %v, received '%v'.", addrs[0], err)
+	}
+	if err = rawRequest(addrs[1], simpleRoute); err != nil {
+		t.Errorf("Expected the server to keep serving %v, received '%v'.", addrs[1], err)
+	}
+}
+
+func TestReuseListenersRepeatedly(t *testing.T) {
+	var err error
+	server := testServer()
+
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that replaced listeners are no longer managed.
+	for i := 0; i < 5; i++ {
+		server.ReuseListeners(server.Detach())
+		for _, addr := range addrs {
+			if err = server.Listen(addr); err != nil {
+				t.Fatalf("Expected no error when listening, received '%v'.", err)
+			}
+		}
+		server.Serve()
+
+		if count := len(server.Addrs()); count != len(addrs) {
+			t.Fatalf("Expected %v managed listeners, received '%v'.", len(addrs), count)
+		}
+		for _, addr := range addrs {
+			if err = httpRequestSuccess(addr, simpleRoute); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Ensure that replaced listeners do not keep the server from shutting
+	// down.
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down.")
+	}
+}
+
+func TestReuseListenersOnce(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+	server.ReuseListeners(server.Detach())
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if !server.StartupMetrics().Binds[addrs[0]].Reused {
+		t.Error("Expected the listener to be reused.")
+	}
+	server.Serve()
+	server.Shutdown()
+
+	// Ensure that the consumed descriptor is not reused when listening on
+	// the address again, as its number may belong to another socket.
+	if _, exists := server.reuseListeners[addrs[0]]; exists {
+		t.Error("Expected the consumed descriptor to be forgotten.")
+	}
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if server.StartupMetrics().Binds[addrs[0]].Reused {
+		t.Error("Expected a new listener to be created.")
+	}
+	server.Serve()
+	if err = httpRequestSuccess(addrs[0], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSNIMismatchPolicy(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.SNIMismatchPolicy = SNIMismatchReject
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that a matching server name is still served.
+	if err = httpsRequestSuccess(addrs[0], addrToServerName[addrs[0]], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that a mismatched server name is rejected after the handshake.
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				ServerName:         "invalid.example.com",
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	resp, err := client.Get("https://" + addrs[0] + simpleRoute)
+	if err != nil {
+		t.Fatalf("Expected no error from the handshake, received '%v'.", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status code %v, received '%v'.", http.StatusMisdirectedRequest, resp.StatusCode)
+	}
+}
+
+func TestStartupMetrics(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err := server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that each bind, and the overall startup, was timed.
+	metrics := server.StartupMetrics()
+	if len(metrics.Binds) != len(addrs) {
+		t.Fatalf("Expected %v binds, received '%v'.", len(addrs), len(metrics.Binds))
+	}
+	for _, addr := range addrs {
+		bind, exists := metrics.Binds[addr]
+		if !exists {
+			t.Errorf("Expected bind metrics for %v to exist.", addr)
+			continue
+		}
+		if bind.Reused {
+			t.Errorf("Expected %v to not be reused.", addr)
+		}
+		if bind.Duration <= 0 || bind.Duration > metrics.ReadyDuration {
+			t.Errorf("Expected bind duration for %v to be within '%v', received '%v'.", addr, metrics.ReadyDuration, bind.Duration)
+		}
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	// Give the second listener its own configuration, with only its own
+	// certificate.
+	cert, err := tls.LoadX509KeyPair("./test/srv2.localhost.crt", "./test/srv2.localhost.key")
+	if err != nil {
+		t.Fatalf("Expected no error when loading TLS certificate, received '%v'.", err)
+	}
+	if err = server.ListenTLS(addrs[1], &tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that each listener presents its own certificate.
+	for addr, serverName := range addrToServerName {
+		if err = httpsRequestSuccess(addr, serverName, simpleRoute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tlsHandshake(addrs[1], addrToServerName[addrs[0]]); err == nil {
+		t.Errorf("Expected an error from %v for %v, received none.", addrs[1], addrToServerName[addrs[0]])
+	}
+	if err = tlsHandshake(addrs[0], addrToServerName[addrs[1]]); err == nil {
+		t.Errorf("Expected an error from %v for %v, received none.", addrs[0], addrToServerName[addrs[1]])
+	}
+}
+
+func TestReloadTLSCertificate(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the original certificate is presented.
+	if name, err := peerCommonName(addrs[0]); err != nil || name != "srv1.localhost" {
+		t.Fatalf("Expected certificate for srv1.localhost, received '%v' ('%v').", name, err)
+	}
+
+	// Both certificates cover 127.0.0.1, so the reloaded certificate should
+	// replace the original one.
+	if err = server.ReloadTLSCertificate("./test/srv2.localhost.crt", "./test/srv2.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when reloading TLS certificate, received '%v'.", err)
+	}
+
+	// Ensure that the reloaded certificate is presented to new connections.
+	if name, err := peerCommonName(addrs[0]); err != nil || name != "srv2.localhost" {
+		t.Fatalf("Expected certificate for srv2.localhost, received '%v' ('%v').", name, err)
+	}
+	if len(server.TLS.Certificates) != 1 {
+		t.Errorf("Expected one certificate, received '%v'.", len(server.TLS.Certificates))
+	}
+}
+
+func TestAddInvalidTLSCertificate(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	// Ensure that an expired certificate is refused.
+	err := server.AddTLSCertificateFromFile("./test/expired.localhost.crt", "./test/expired.localhost.key")
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("Expected an error about the expired certificate, received '%v'.", err)
+	}
+	if server.TLS != nil && len(server.TLS.Certificates) != 0 {
+		t.Fatalf("Expected no certificates, found %v.", len(server.TLS.Certificates))
+	}
+
+	// Ensure that it can be added intentionally.
+	server.AllowInvalidCertificates = true
+	if err = server.AddTLSCertificateFromFile("./test/expired.localhost.crt", "./test/expired.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	if len(server.TLS.Certificates) != 1 {
+		t.Fatalf("Expected 1 certificate, found %v.", len(server.TLS.Certificates))
+	}
+}
+
+func TestAddTLSCertificatesFromDir(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+
+	// Build a directory with two valid pairs, one of them laid out as by
+	// certbot, and one malformed pair.
+	dir := t.TempDir()
+	files := map[string]string{
+		"./test/srv1.localhost.crt": filepath.Join(dir, "srv1.localhost.crt"),
+		"./test/srv1.localhost.key": filepath.Join(dir, "srv1.localhost.key"),
+		"./test/srv2.localhost.crt": filepath.Join(dir, "srv2.localhost", "fullchain.pem"),
+		"./test/srv2.localhost.key": filepath.Join(dir, "srv2.localhost", "privkey.pem"),
+	}
+	if err := os.Mkdir(filepath.Join(dir, "srv2.localhost"), 0700); err != nil {
+		t.Fatalf("Expected no error creating the directory, received '%v'.", err)
+	}
+	for src, dst := range files {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatalf("Expected no error reading %v, received '%v'.", src, err)
+		}
+		if err = os.WriteFile(dst, data, 0600); err != nil {
+			t.Fatalf("Expected no error writing %v, received '%v'.", dst, err)
+		}
+	}
+	for _, name := range []string{"malformed.crt", "malformed.key"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("malformed"), 0600); err != nil {
+			t.Fatalf("Expected no error writing %v, received '%v'.", name, err)
+		}
+	}
+
+	// Ensure that the malformed pair is reported, and the others are added.
+	err := server.AddTLSCertificatesFromDir(dir)
+	errs, ok := err.(CertificateErrors)
+	if !ok {
+		t.Fatalf("Expected CertificateErrors, received '%v'.", err)
+	}
+	if len(errs) != 1 || errs[filepath.Join(dir, "malformed.crt")] == nil {
+		t.Errorf("Expected an error for malformed.crt only, received '%v'.", err)
+	}
+	if len(server.TLS.Certificates) != 2 {
+		t.Fatalf("Expected 2 certificates, found %v.", len(server.TLS.Certificates))
+	}
+
+	server.Serve()
+	for _, serverName := range []string{"srv1.localhost", "srv2.localhost"} {
+		if err = tlsHandshake(addrs[0], serverName); err != nil {
+			t.Errorf("Expected no error from %v, received '%v'.", serverName, err)
+		}
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if certs := server.Certificates(); len(certs) != 0 {
+		t.Fatalf("Expected no certificates, received '%v'.", certs)
+	}
+	for _, name := range []string{"srv1.localhost", "srv2.localhost"} {
+		if err := server.AddTLSCertificateFromFile("./test/"+name+".crt", "./test/"+name+".key"); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+
+	// Ensure that each certificate is described, in the order it was added.
+	certs := server.Certificates()
+	if len(certs) != 2 {
+		t.Fatalf("Expected 2 certificates, received '%v'.", certs)
+	}
+	for i, name := range []string{"srv1.localhost", "srv2.localhost"} {
+		if certs[i].CommonName != name {
+			t.Errorf("Expected a common name of '%v', received '%v'.", name, certs[i].CommonName)
+		}
+		if len(certs[i].DNSNames) != 1 || certs[i].DNSNames[0] != name {
+			t.Errorf("Expected DNS names of '[%v]', received '%v'.", name, certs[i].DNSNames)
+		}
+		if now := time.Now(); now.Before(certs[i].NotBefore) || now.After(certs[i].NotAfter) {
+			t.Errorf("Expected %v to be valid now, received '%v' to '%v'.", name, certs[i].NotBefore, certs[i].NotAfter)
+		}
+	}
+}
+
+func TestRemoveTLSCertificate(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv2.localhost.crt", "./test/srv2.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	if err = tlsHandshake(addrs[0], "srv2.localhost"); err != nil {
+		t.Fatalf("Expected no error from srv2.localhost, received '%v'.", err)
+	}
+	if err = server.RemoveTLSCertificate("missing.localhost"); err == nil {
+		t.Error("Expected an error when removing a missing certificate.")
+	}
+	if err = server.RemoveTLSCertificate("srv2.localhost"); err != nil {
+		t.Fatalf("Expected no error when removing TLS certificate, received '%v'.", err)
+	}
+
+	// Ensure that the removed name is no longer served, but the other is.
+	if err = tlsHandshake(addrs[0], "srv2.localhost"); err == nil {
+		t.Error("Expected an error from srv2.localhost after its certificate was removed.")
+	}
+	if err = tlsHandshake(addrs[0], "srv1.localhost"); err != nil {
+		t.Errorf("Expected no error from srv1.localhost, received '%v'.", err)
+	}
+
+	// Ensure that the last certificate of a serving listener is kept.
+	if err = server.RemoveTLSCertificate("srv1.localhost"); err == nil {
+		t.Error("Expected an error when removing the last certificate.")
+	}
+	if err = tlsHandshake(addrs[0], "srv1.localhost"); err != nil {
+		t.Errorf("Expected no error from srv1.localhost, received '%v'.", err)
+	}
+}
+
+func TestListenAddr(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	addr, err := server.ListenAddr("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the chosen port was returned.
+	if tcpAddr, ok := addr.(*net.TCPAddr); !ok || tcpAddr.Port == 0 {
+		t.Fatalf("Expected a bound TCP address, received '%v'.", addr)
+	}
+	if err = rawRequest(addr.String(), simpleRoute); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	// Occupy the second address, so that listening on it fails.
+	occupied, err := net.Listen("tcp", addrs[1])
+	if err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	defer occupied.Close()
+
+	if err = server.ListenAll(addrs[0], addrs[1]); err == nil {
+		t.Fatal("Expected an error when listening on an address in use.")
+	} else if !strings.Contains(err.Error(), addrs[1]) {
+		t.Errorf("Expected the error to name %v, received '%v'.", addrs[1], err)
+	}
+
+	// Ensure that the first listener was cleaned up.
+	if count := len(server.Addrs()); count != 0 {
+		t.Errorf("Expected no managed listeners, received '%v'.", count)
+	}
+	first, err := net.Listen("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected %v to be free, received '%v'.", addrs[0], err)
+	}
+	first.Close()
+
+	occupied.Close()
+	if err = server.ListenAll(addrs...); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+	for _, addr := range addrs {
+		if err = httpRequestSuccess(addr, simpleRoute); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.RedirectToHTTPS(addrs[0], ""); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.RedirectToHTTPS(addrs[1], "secure.localhost:8443"); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	// The redirecting listeners should not be affected by certificates.
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	tests := []struct {
+		addr, host, uri, location string
+	}{
+		{addrs[0], "srv1.localhost:8080", "/path/to?a=1&b=2", "https://srv1.localhost/path/to?a=1&b=2"},
+		{addrs[0], "srv1.localhost", "/", "https://srv1.localhost/"},
+		{addrs[0], "[::1]:8080", "/path", "https://[::1]/path"},
+		{addrs[1], "srv2.localhost:8080", "/path?q", "https://secure.localhost:8443/path?q"},
+	}
+	for _, test := range tests {
+		c, err := net.Dial("tcp", test.addr)
+		if err != nil {
+			t.Fatalf("Expected no error when connecting to %v, received '%v'.", test.addr, err)
+		}
+		fmt.Fprintf(c, "GET %v HTTP/1.0\r\nHost: %v\r\n\r\n", test.uri, test.host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatalf("Expected no error reading from %v, received '%v'.", test.addr, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("Expected status %v, received '%v'.", http.StatusMovedPermanently, resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != test.location {
+			t.Errorf("Expected location '%v', received '%v'.", test.location, location)
+		}
+	}
+}
+
+func TestACMEAndRedirectHandler(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	challenge := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "challenge response")
+	})
+	server.SetHandler(server.ACMEAndRedirectHandler(challenge, ""))
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	tests := []struct {
+		uri, location, body string
+		status              int
+	}{
+		{"/.well-known/acme-challenge/token", "", "challenge response", http.StatusOK},
+		{"/path?q", "https://srv1.localhost/path?q", "", http.StatusMovedPermanently},
+	}
+	for _, test := range tests {
+		c, err := net.Dial("tcp", addrs[0])
+		if err != nil {
+			t.Fatalf("Expected no error when connecting to %v, received '%v'.", addrs[0], err)
+		}
+		fmt.Fprintf(c, "GET %v HTTP/1.0\r\nHost: srv1.localhost:8080\r\n\r\n", test.uri)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			c.Close()
+			t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Close()
+		if err != nil {
+			t.Fatalf("Expected no error reading the body, received '%v'.", err)
+		}
+		if resp.StatusCode != test.status {
+			t.Errorf("Expected status %v for %v, received '%v'.", test.status, test.uri, resp.StatusCode)
+		}
+		if location := resp.Header.Get("Location"); location != test.location {
+			t.Errorf("Expected location '%v', received '%v'.", test.location, location)
+		}
+		if test.body != "" && string(body) != test.body {
+			t.Errorf("Expected body '%v', received '%v'.", test.body, string(body))
+		}
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	server := testServer()
+	client, c := net.Pipe()
+	defer client.Close()
+
+	served := make(chan struct{})
+	go func() {
+		server.ServeConn(c)
+		close(served)
+	}()
+
+	// Ensure that the request is handled, and that ServeConn returns once
+	// the connection is closed.
+	fmt.Fprintf(client, "GET %v HTTP/1.0\r\nHost: localhost\r\n\r\n", simpleRoute)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from the pipe, received '%v'.", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "Success\n" {
+		t.Errorf("Expected a 200 with body 'Success', received '%v' with body '%v'.", resp.StatusCode, string(body))
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ServeConn to return once the connection was closed.")
+	}
+
+	// Ensure that the server accounts for connections that are kept alive.
+	client, c = net.Pipe()
+	defer client.Close()
+	go server.ServeConn(c)
+	fmt.Fprintf(client, "GET %v HTTP/1.1\r\nHost: localhost\r\n\r\n", simpleRoute)
+	if resp, err = http.ReadResponse(bufio.NewReader(client), nil); err != nil {
+		t.Fatalf("Expected no error reading from the pipe, received '%v'.", err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if len(server.Addrs()) != 1 {
+		t.Errorf("Expected one managed listener, received '%v'.", len(server.Addrs()))
+	}
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down.")
+	}
+}
+
+func TestServeConnNotServed(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	// Shutting down the http.Server before it begins serving means the
+	// connection is never handed to it, as happens when the listener is shut
+	// down at that moment.
+	server.ConfigureHTTPServer(func(httpServer *http.Server) {
+		httpServer.Shutdown(context.Background())
+	})
+	client, c := net.Pipe()
+	defer client.Close()
+	served := make(chan struct{})
+	go func() {
+		server.ServeConn(c)
+		close(served)
+	}()
+
+	// Ensure that ServeConn returns, and that the connection is closed.
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ServeConn to return once serving stopped.")
+	}
+	if _, err := client.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err == nil {
+		t.Error("Expected the connection to be closed.")
+	}
+}
+
+func TestWait(t *testing.T) {
+	server := testServer()
+
+	// Ensure that there is nothing to wait for without listeners.
+	done := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Wait to return without listeners.")
+	}
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that Wait blocks until the server has been shut down.
+	done = make(chan struct{})
+	go func() {
+		server.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected Wait to block while the server is serving.")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+
+	go server.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Wait to return once the server was shut down.")
+	}
+	if count := len(server.Addrs()); count != 0 {
+		t.Errorf("Expected no managed listeners, received '%v'.", count)
+	}
+}
+
+func TestListenOnInterface(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	iface, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("Loopback interface is unavailable: %v", err)
+	}
+	ifaceAddrs, _ := iface.Addrs()
+
+	if err = server.ListenOnInterface("missing0", 0); err == nil {
+		t.Error("Expected an error when listening on a missing interface.")
+	}
+	if err = server.ListenOnInterface(iface.Name, 0); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that each of the interface's addresses is served.
+	listening := server.Addrs()
+	if len(listening) != len(ifaceAddrs) {
+		t.Errorf("Expected %v listeners, received '%v'.", len(ifaceAddrs), listening)
+	}
+	for _, addr := range listening {
+		if err = rawRequest(addr.String(), simpleRoute); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestAttach(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Attach(l)
+	server.Serve()
+
+	// Ensure that the attached listener is serving requests.
+	if err = rawRequest(l.Addr().String(), simpleRoute); err != nil {
+		t.Error(err)
+	}
+	if addrs := server.Addrs(); len(addrs) != 1 || addrs[0].String() != l.Addr().String() {
+		t.Errorf("Expected the address %v, received '%v'.", l.Addr(), addrs)
+	}
+
+	// Ensure that the attached listener is closed when shutting down.
+	server.Shutdown()
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Error("Expected the attached listener to be closed.")
+	}
+}
+
+func TestServeMux(t *testing.T) {
+	first, second := testServer(), testServer()
+	defer first.Shutdown()
+	defer second.Shutdown()
+
+	const route = "/servemux"
+	http.DefaultServeMux.HandleFunc(route, simpleHandler)
+	first.HandleFunc(route+"/first", simpleHandler)
+	if err := first.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err := second.Listen(addrs[1]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	first.Serve()
+	second.Serve()
+
+	// Ensure that each server only serves the handlers registered with it.
+	if err := rawRequest(addrs[0], route+"/first"); err != nil {
+		t.Error(err)
+	}
+	if err := rawRequest(addrs[1], route+"/first"); err == nil {
+		t.Error("Expected a handler registered with another server to not be served.")
+	}
+	if err := rawRequest(addrs[0], route); err == nil {
+		t.Error("Expected a handler registered with http.DefaultServeMux to not be served.")
+	}
+}
+
+func TestAddrs(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err := server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+
+	// Ensure that the address of each listener is returned.
+	listening := make(map[string]bool)
+	for _, addr := range server.Addrs() {
+		listening[addr.String()] = true
+	}
+	if len(listening) != len(addrs) {
+		t.Errorf("Expected %v addresses, received '%v'.", len(addrs), server.Addrs())
+	}
+	for _, addr := range addrs {
+		if !listening[addr] {
+			t.Errorf("Expected '%v' to be returned, received '%v'.", addr, server.Addrs())
+		}
+	}
+
+	// Ensure that no addresses are returned once shut down.
+	server.Shutdown()
+	if listening := server.Addrs(); len(listening) != 0 {
+		t.Errorf("Expected no addresses, received '%v'.", listening)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	var err error
+	path := filepath.Join(t.TempDir(), "server.sock")
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.ListenUnix(path); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the server is accepting connections over the socket.
+	if err = unixRequest(path, simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that a detached listener can be reused, and that the socket file
+	// outlives the server it was detached from.
+	detachedListeners := server.Detach()
+	if _, exists := detachedListeners["unix:"+path]; !exists {
+		t.Fatalf("Expected the Unix listener to be detached, received '%v'.", detachedListeners)
+	}
+	reused := testServer()
+	defer reused.Shutdown()
+	reused.ReuseListeners(detachedListeners)
+	if err = reused.ListenUnix(path); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if !reused.StartupMetrics().Binds["unix:"+path].Reused {
+		t.Error("Expected the Unix listener to be reused.")
+	}
+	reused.Serve()
+	server.Shutdown()
+	if err = unixRequest(path, simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that the socket file is removed on shutdown.
+	reused.Shutdown()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket file to be removed, received '%v'.", err)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	server.EnableHTTP2()
+	server.Serve()
+
+	// Ensure that an HTTP/2 capable client negotiates HTTP/2.
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName: addrToServerName[addrs[0]],
+			RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+		},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("https://" + addrs[0] + simpleRoute)
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 to be negotiated, received '%v'.", resp.Proto)
+	}
+
+	// Ensure that HTTP/1.1 clients are still served.
+	if err = httpsRequestSuccess(addrs[0], addrToServerName[addrs[0]], simpleRoute); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConfigureHTTPServer(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	type contextKey struct{}
+	server.ConfigureHTTPServer(func(httpServer *http.Server) {
+		httpServer.BaseContext = func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), contextKey{}, "configured")
+		}
+	})
+	server.ServeMux.HandleFunc("/context", func(w http.ResponseWriter, r *http.Request) {
+		value, _ := r.Context().Value(contextKey{}).(string)
+		w.Write([]byte(value))
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the handler sees the configured context, and that the
+	// request is still accounted for.
+	resp, err := http.Get("http://" + addrs[0] + "/context")
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Expected no error reading the body, received '%v'.", err)
+	}
+	if string(body) != "configured" {
+		t.Errorf("Expected the context value 'configured', received '%v'.", string(body))
+	}
+	if served := server.Stats().Listeners[addrs[0]].ServedRequests; served != 1 {
+		t.Errorf("Expected 1 request served by the listener, received '%v'.", served)
+	}
+}
+
+func TestEnableH2C(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.EnableH2C()
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that HTTP/2 is spoken over a plain connection.
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("http://" + addrs[0] + simpleRoute)
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.ProtoMajor != 2 {
+		t.Errorf("Expected a 200 over HTTP/2, received '%v' over '%v'.", resp.StatusCode, resp.Proto)
+	}
+
+	// Ensure that HTTP/1.1 is still served, and that shutting down reaches
+	// the HTTP/2 connection.
+	if err = rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down.")
+	}
+}
+
+func TestEnableH2CUpgrade(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.EnableH2C()
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Ensure that a plain HTTP/1.1 request can upgrade the connection.
+	fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+		"Upgrade: h2c\r\nHTTP2-Settings: \r\n\r\n", simpleRoute, addrs[0])
+	reader := bufio.NewReader(c)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading the upgrade response, received '%v'.", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected a '101' response, received '%v'.", resp.StatusCode)
+	}
+
+	// Ensure that the upgrade request is answered over HTTP/2, on stream 1.
+	c.Write([]byte(http2.ClientPreface))
+	framer := http2.NewFramer(c, reader)
+	if err = framer.WriteSettings(); err != nil {
+		t.Fatalf("Expected no error writing settings, received '%v'.", err)
+	}
+	var status string
+	for status == "" {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Expected no error reading a frame, received '%v'.", err)
+		}
+		headers, ok := frame.(*http2.HeadersFrame)
+		if !ok || headers.StreamID != 1 {
+			continue
+		}
+		fields, err := hpack.NewDecoder(4096, nil).DecodeFull(headers.HeaderBlockFragment())
+		if err != nil {
+			t.Fatalf("Expected no error decoding headers, received '%v'.", err)
+		}
+		for _, field := range fields {
+			if field.Name == ":status" {
+				status = field.Value
+			}
+		}
+	}
+	if status != "200" {
+		t.Errorf("Expected a '200' response, received '%v'.", status)
+	}
+
+	// Ensure that shutting down tells the upgraded connection to go away.
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("Expected a GOAWAY frame, received '%v'.", err)
+		}
+		if _, ok := frame.(*http2.GoAwayFrame); ok {
+			break
+		}
+	}
+	c.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down.")
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ReadTimeout = 100 * time.Millisecond
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+
+	// Send part of a request, and then stall.
+	fmt.Fprintf(c, "GET %v HTTP/1.1\r\nHost: %v\r\n", simpleRoute, addrs[0])
+
+	// Ensure that the server drops the connection once the timeout expires.
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.Copy(io.Discard, c); err != nil {
+		t.Errorf("Expected the stalled connection to be closed by the server, received '%v'.", err)
+	}
+	if active := server.ActiveRequests(); active != 0 {
+		t.Errorf("Expected no active requests, received '%v'.", active)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.MaxHeaderBytes = 1024
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that headers within the limit are accepted.
+	if err := rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+
+	// Ensure that oversized headers are rejected.  The http.Server allows
+	// some slack beyond the limit, so the header is well past it.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET %v HTTP/1.0\r\nHost: %v\r\nX-Large: %v\r\n\r\n", simpleRoute, addrs[0], strings.Repeat("a", 16384))
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected status code 431 from %v, received '%v'.", addrs[0], resp.StatusCode)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.TLSHandshakeTimeout = 100 * time.Millisecond
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Connect, and then never begin the handshake.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+
+	// Ensure that the server drops the connection once the timeout expires.
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err = io.Copy(io.Discard, c); err != nil {
+		t.Errorf("Expected the stalled connection to be closed by the server, received '%v'.", err)
+	}
+
+	// Ensure that handshakes that complete in time are unaffected.
+	if err = tlsHandshake(addrs[0], "srv1.localhost"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ServeMux.HandleFunc("/client", func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(w, "no verified client certificate", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, req.TLS.VerifiedChains[0][0].Subject.CommonName)
+	})
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	if err = server.RequireClientCert([]byte("not a certificate")); err == nil {
+		t.Error("Expected an error when requiring client certificates from an invalid bundle.")
+	}
+	caCert, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		t.Fatalf("Expected no error reading the CA certificate, received '%v'.", err)
+	}
+	if err = server.RequireClientCert(caCert); err != nil {
+		t.Fatalf("Expected no error when requiring client certificates, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that a trusted client certificate is accepted, and its verified
+	// chain is available to handlers.
+	body, err := clientCertRequest(addrs[0], "./test/client.localhost.crt", "./test/client.localhost.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "client.localhost" {
+		t.Errorf("Expected the verified client certificate 'client.localhost', received '%v'.", body)
+	}
+
+	// Ensure that an untrusted client certificate is rejected.
+	if _, err = clientCertRequest(addrs[0], "./test/untrusted.localhost.crt", "./test/untrusted.localhost.key"); err == nil {
+		t.Error("Expected an untrusted client certificate to be rejected.")
+	}
+
+	// Ensure that a client without a certificate is rejected.
+	if _, err = clientCertRequest(addrs[0], "", ""); err == nil {
+		t.Error("Expected a client without a certificate to be rejected.")
+	}
+}
+
+// clientCertRequest makes a HTTPS request, over a new connection, to the given
+// server, presenting the provided client certificate (if any), and returns the
+// response body.
+func clientCertRequest(addr, certFile, keyFile string) (string, error) {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName: addrToServerName[addr],
+			RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+		},
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return "", fmt.Errorf("Expected no error loading the client certificate, received '%v'.", err)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	}
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + addr + "/client")
+	if err != nil {
+		return "", fmt.Errorf("Expected no error from %v, received '%v'.", addr, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("Expected no error reading from %v, received '%v'.", addr, err)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("Expected status code 200 from %v, received '%v'.", addr, resp.StatusCode)
+	}
+	return string(body), nil
+}
+
+func TestEnableAutocert(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	// Seed the manager's cache, so that a certificate can be obtained without
+	// contacting an ACME server.
+	key, err := ioutil.ReadFile("./test/autocert.localhost.key")
+	if err != nil {
+		t.Fatalf("Expected no error reading the key, received '%v'.", err)
+	}
+	cert, err := ioutil.ReadFile("./test/autocert.localhost.crt")
+	if err != nil {
+		t.Fatalf("Expected no error reading the certificate, received '%v'.", err)
+	}
+	cache := &countingCache{Cache: autocert.DirCache(t.TempDir())}
+	if err = cache.Put(context.Background(), "autocert.localhost", append(key, cert...)); err != nil {
+		t.Fatalf("Expected no error seeding the cache, received '%v'.", err)
+	}
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.EnableAutocert(&autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist("autocert.localhost"),
+		Cache:      cache,
+	})
+	server.Serve()
+
+	// Ensure that the challenge protocol can be negotiated.
+	var challenge bool
+	for _, proto := range server.TLS.NextProtos {
+		challenge = challenge || proto == acme.ALPNProto
+	}
+	if !challenge {
+		t.Errorf("Expected '%v' in NextProtos, received '%v'.", acme.ALPNProto, server.TLS.NextProtos)
+	}
+
+	// Ensure that the certificate is obtained from the manager during the
+	// handshake.
+	if err = tlsHandshake(addrs[0], "autocert.localhost"); err != nil {
+		t.Errorf("Expected no error from the handshake, received '%v'.", err)
+	}
+	if cache.gets() == 0 {
+		t.Error("Expected the manager to be asked for a certificate.")
+	}
+
+	// Ensure that the manager's host policy is enforced.
+	if err = tlsHandshake(addrs[0], "srv1.localhost"); err == nil {
+		t.Error("Expected the handshake for a disallowed host to fail.")
+	}
+}
+
+// countingCache is an autocert.Cache that counts how many times it has been
+// read from.
+type countingCache struct {
+	autocert.Cache
+	count int32
+}
+
+// Get implements the Get() method of the autocert.Cache interface.
+func (c *countingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.Cache.Get(ctx, key)
+}
+
+// gets returns how many times the cache has been read from.
+func (c *countingCache) gets() int32 {
+	return atomic.LoadInt32(&c.count)
+}
+
+func TestUse(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, name := range []string{"first", "second"} {
+		name := name
+		server.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Middleware", name)
+				next.ServeHTTP(w, r)
+			})
+		})
+	}
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the middleware ran, in registration order, before the
+	// request was dispatched.
+	req, err := http.NewRequest("GET", "http://"+addrs[0]+simpleRoute, nil)
+	if err != nil {
+		t.Fatalf("Expected no error creating the request, received '%v'.", err)
+	}
+	req.Close = true
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status code 200, received '%v'.", resp.StatusCode)
+	}
+	order := resp.Header["X-Middleware"]
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("Expected middleware to run in order 'first, second', received '%v'.", order)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	server := New()
+	defer server.Shutdown()
+
+	server.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "applied")
+			next.ServeHTTP(w, r)
+		})
+	})
+	server.Handle("/handle", http.HandlerFunc(simpleHandler))
+	server.HandleFunc("/handlefunc", simpleHandler)
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that both routes are served, through the middleware.
+	for _, route := range []string{"/handle", "/handlefunc"} {
+		req, err := http.NewRequest("GET", "http://"+addrs[0]+route, nil)
+		if err != nil {
+			t.Fatalf("Expected no error creating the request, received '%v'.", err)
+		}
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Errorf("Expected status code 200 for %v, received '%v'.", route, resp.StatusCode)
+		}
+		if applied := resp.Header.Get("X-Middleware"); applied != "applied" {
+			t.Errorf("Expected middleware to be applied to %v, received '%v'.", route, applied)
+		}
+	}
+	if served := server.Stats().ServedRequests; served != 2 {
+		t.Errorf("Expected 2 served requests, received '%v'.", served)
+	}
+}
+
+// testRouter is a minimal router, standing in for one from another package.
+type testRouter map[string]http.HandlerFunc
+
+// ServeHTTP implements the ServeHTTP() method of the http.Handler interface.
+func (router testRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := router[r.URL.Path]; ok {
+		handler(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func TestSetHandler(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Middleware", "applied")
+			next.ServeHTTP(w, r)
+		})
+	})
+	server.SetHandler(testRouter{"/router": simpleHandler})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	get := func(route string) (int, string) {
+		req, err := http.NewRequest("GET", "http://"+addrs[0]+route, nil)
+		if err != nil {
+			t.Fatalf("Expected no error creating the request, received '%v'.", err)
+		}
+		req.Close = true
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("X-Middleware")
+	}
+
+	// Ensure that the handler is used instead of the ServeMux, through the
+	// middleware.
+	if status, applied := get("/router"); status != 200 || applied != "applied" {
+		t.Errorf("Expected a 200 through the middleware, received '%v' with '%v'.", status, applied)
+	}
+	if status, _ := get(simpleRoute); status != 404 {
+		t.Errorf("Expected the ServeMux to be bypassed, received '%v'.", status)
+	}
+
+	// Ensure that removing the handler restores the ServeMux.
+	server.SetHandler(nil)
+	if status, _ := get(simpleRoute); status != 200 {
+		t.Errorf("Expected the ServeMux to be used, received '%v'.", status)
+	}
+	if served := server.Stats().ServedRequests; served != 3 {
+		t.Errorf("Expected 3 served requests, received '%v'.", served)
+	}
+}
+
+func TestSetMaxBodySize(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.SetMaxBodySize(16)
+	server.ServeMux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "Success")
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{strings.Repeat("a", 16), http.StatusOK},
+		{strings.Repeat("a", 17), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		resp, err := http.Post("http://"+addrs[0]+"/upload", "text/plain", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("Expected status %v for a %v byte body, received '%v'.", test.status, len(test.body), resp.StatusCode)
+		}
+	}
+}
+
+func TestSetHandlerTimeout(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.SetHandlerTimeout(50*time.Millisecond, "too slow")
+	server.ServeMux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the slow handler was cut off.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET /slow HTTP/1.0\r\nHost: %v\r\n\r\n", addrs[0])
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || string(body) != "too slow" {
+		t.Errorf("Expected a 503 with body 'too slow', received '%v' with body '%v'.", resp.StatusCode, string(body))
+	}
+
+	// Ensure that fast handlers are unaffected.
+	if err = rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	recoveredValues := make(chan interface{}, 1)
+	server.PanicHandler = func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+		recoveredValues <- recovered
+		http.Error(w, "recovered", http.StatusInternalServerError)
+	}
+	server.ServeMux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("handler panicked")
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the panic handler wrote the response.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET /panic HTTP/1.0\r\nHost: %v\r\n\r\n", addrs[0])
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || strings.TrimSpace(string(body)) != "recovered" {
+		t.Errorf("Expected a 500 with body 'recovered', received '%v' with body '%v'.", resp.StatusCode, string(body))
+	}
+	select {
+	case recovered := <-recoveredValues:
+		if recovered != "handler panicked" {
+			t.Errorf("Expected the recovered value 'handler panicked', received '%v'.", recovered)
+		}
+	default:
+		t.Error("Expected the panic handler to be called.")
+	}
+
+	// Ensure that the request is no longer counted as active.
+	if active := server.ActiveRequests(); active != 0 {
+		t.Errorf("Expected no active requests, received '%v'.", active)
+	}
+}
+
+func TestTLSVersions(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that TLS 1.0 is rejected by default.
+	if err = tlsVersionHandshake(addrs[0], tls.VersionTLS10); err == nil {
+		t.Error("Expected a TLS 1.0 handshake to be rejected.")
+	}
+	if err = tlsVersionHandshake(addrs[0], tls.VersionTLS12); err != nil {
+		t.Errorf("Expected a TLS 1.2 handshake to succeed, received '%v'.", err)
+	}
+	server.Shutdown()
+
+	// Ensure that the configured versions are applied to listeners.
+	if err = server.Listen(addrs[1]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.SetTLSVersions(tls.VersionTLS13, tls.VersionTLS13)
+	server.Serve()
+	if err = tlsVersionHandshake(addrs[1], tls.VersionTLS12); err == nil {
+		t.Error("Expected a TLS 1.2 handshake to be rejected.")
+	}
+	if err = tlsVersionHandshake(addrs[1], tls.VersionTLS13); err != nil {
+		t.Errorf("Expected a TLS 1.3 handshake to succeed, received '%v'.", err)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+	if err = tlsVersionHandshake(addrs[0], tls.VersionTLS12); err != nil {
+		t.Fatalf("Expected a TLS 1.2 handshake to succeed, received '%v'.", err)
+	}
+
+	// Ensure that new connections honor the new configuration.
+	if err = server.Reconfigure(func(config *tls.Config) {
+		config.MinVersion = tls.VersionTLS13
+	}); err != nil {
+		t.Fatalf("Expected no error when reconfiguring, received '%v'.", err)
+	}
+	if err = tlsVersionHandshake(addrs[0], tls.VersionTLS12); err == nil {
+		t.Error("Expected a TLS 1.2 handshake to be rejected.")
+	}
+	if err = tlsVersionHandshake(addrs[0], tls.VersionTLS13); err != nil {
+		t.Errorf("Expected a TLS 1.3 handshake to succeed, received '%v'.", err)
+	}
+
+	// Ensure that the serving listener can not be left without a certificate.
+	if err = server.Reconfigure(func(config *tls.Config) {
+		config.Certificates = nil
+	}); err == nil {
+		t.Error("Expected an error when removing every certificate.")
+	}
+	if err = tlsVersionHandshake(addrs[0], tls.VersionTLS13); err != nil {
+		t.Errorf("Expected the configuration to be unchanged, received '%v'.", err)
+	}
+}
+
+func TestTLSClientSessionCache(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	cache := tls.NewLRUClientSessionCache(16)
+	server.TLSClientSessionCache = cache
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err := server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+
+	// Ensure that the cache is set on the server's and the listener's
+	// configurations.
+	if server.TLS.ClientSessionCache != cache {
+		t.Error("Expected the client session cache to be set on the server's TLS configuration.")
+	}
+	if config := server.listeners.listeners[0].serverTLSConfig(); config == nil || config.ClientSessionCache != cache {
+		t.Error("Expected the client session cache to be set on the listener's TLS configuration.")
+	}
+}
+
+func TestSetRenegotiation(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.SetRenegotiation(tls.RenegotiateOnceAsClient)
+
+	// Ensure that the policy is set for the server and its listener.
+	if server.TLS.Renegotiation != tls.RenegotiateOnceAsClient {
+		t.Errorf("Expected '%v', received '%v'.", tls.RenegotiateOnceAsClient, server.TLS.Renegotiation)
+	}
+	listener := server.listeners.listeners[0]
+	listener.tlsMutex.RLock()
+	renegotiation := listener.tlsConfig.Renegotiation
+	listener.tlsMutex.RUnlock()
+	if renegotiation != tls.RenegotiateOnceAsClient {
+		t.Errorf("Expected the listener to use '%v', received '%v'.", tls.RenegotiateOnceAsClient, renegotiation)
+	}
+}
+
+func TestSetCurvePreferences(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.SetCurvePreferences()
+	if curves := server.TLS.CurvePreferences; len(curves) != 3 || curves[0] != tls.X25519 {
+		t.Errorf("Expected the default curves to prefer X25519, received '%v'.", curves)
+	}
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.SetCurvePreferences(tls.X25519)
+	server.Serve()
+
+	// Ensure that only the configured curve is accepted.
+	handshake := func(curve tls.CurveID) error {
+		c, err := tls.Dial("tcp", addrs[0], &tls.Config{
+			ServerName:       "srv1.localhost",
+			RootCAs:          httpTransport.TLSClientConfig.RootCAs,
+			CurvePreferences: []tls.CurveID{curve},
+		})
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	if err = handshake(tls.CurveP256); err == nil {
+		t.Error("Expected a handshake offering only P-256 to be rejected.")
+	}
+	if err = handshake(tls.X25519); err != nil {
+		t.Errorf("Expected a handshake offering X25519 to succeed, received '%v'.", err)
+	}
+}
+
+func TestSetConfigForClient(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for _, name := range []string{"srv1.localhost", "srv2.localhost"} {
+		if err = server.AddTLSCertificateFromFile("./test/"+name+".crt", "./test/"+name+".key"); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	server.SetConfigForClient(func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		switch hello.ServerName {
+		case "srv1.localhost":
+			return &tls.Config{MaxVersion: tls.VersionTLS12}, nil
+		case "srv2.localhost":
+			return &tls.Config{MinVersion: tls.VersionTLS13}, nil
+		}
+		return nil, errors.New("unknown server name")
+	})
+	server.Serve()
+
+	// Ensure that each server name receives its own configuration, along
+	// with the server's certificates.
+	for serverName, expected := range map[string]uint16{
+		"srv1.localhost": tls.VersionTLS12,
+		"srv2.localhost": tls.VersionTLS13,
+	} {
+		c, err := tls.Dial("tcp", addrs[0], &tls.Config{
+			ServerName: serverName,
+			RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+		})
+		if err != nil {
+			t.Errorf("Expected no error from the handshake for %v, received '%v'.", serverName, err)
+			continue
+		}
+		if version := c.ConnectionState().Version; version != expected {
+			t.Errorf("Expected %v to negotiate %v, received '%v'.", serverName, tls.VersionName(expected), tls.VersionName(version))
+		}
+		c.Close()
+	}
+
+	// Ensure that unknown server names are rejected.
+	if err = tlsHandshake(addrs[0], "unknown.localhost"); err == nil {
+		t.Error("Expected the handshake for an unknown server name to fail.")
+	}
+}
+
+func TestSetNextProtos(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.SetNextProtos("custom/1", "http/1.1")
+	server.Serve()
+
+	// Ensure that the custom protocol is offered, and preferred.
+	c, err := tls.Dial("tcp", addrs[0], &tls.Config{
+		ServerName: "srv1.localhost",
+		RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+		NextProtos: []string{"http/1.1", "custom/1"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	defer c.Close()
+	if proto := c.ConnectionState().NegotiatedProtocol; proto != "custom/1" {
+		t.Errorf("Expected the protocol 'custom/1' to be negotiated, received '%v'.", proto)
+	}
+}
+
+func TestShutdownWithTimeout(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start a long running request.
+	result := make(chan error, 1)
+	go func() {
+		result <- rawRequest(addrs[0], longRunningRoute)
+	}()
+	time.Sleep(250 * time.Millisecond)
+
+	// Ensure that the request is abandoned once the timeout expires.
+	start := time.Now()
+	err := server.ShutdownWithTimeout(250 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected shutdown to finish shortly after the timeout, took '%v'.", elapsed)
+	}
+	timeoutErr, ok := err.(*ShutdownTimeoutError)
+	if !ok {
+		t.Fatalf("Expected a ShutdownTimeoutError, received '%v'.", err)
+	}
+	if timeoutErr.Abandoned != 1 {
+		t.Errorf("Expected one abandoned connection, received '%v'.", timeoutErr.Abandoned)
+	}
+	if err = <-result; err == nil {
+		t.Error("Expected the abandoned request to fail.")
+	}
+}
+
+func TestShutdownWithTimeoutWithoutRequests(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+	if err := httpRequestSuccess(addrs[0], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that the shutdown does not wait out the timeout once there are
+	// no requests left to finish.
+	start := time.Now()
+	if err := server.ShutdownWithTimeout(5 * time.Second); err != nil {
+		t.Fatalf("Expected no error when shutting down, received '%v'.", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected shutdown to finish well before the timeout, took '%v'.", elapsed)
+	}
+}
+
+func TestBeforeShutdown(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the hook runs while the listener is still serving, and
+	// before the shutdown waits for active requests.
+	var called bool
+	var hookErr error
+	server.BeforeShutdown = func() {
+		called = true
+		hookErr = rawRequest(addrs[0], simpleRoute)
+	}
+	server.Shutdown()
+	if !called {
+		t.Fatal("Expected the hook to be called.")
+	}
+	if hookErr != nil {
+		t.Errorf("Expected the listener to be serving during the hook, received '%v'.", hookErr)
+	}
+	if err := rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Error("Expected the listener to be closed after shutting down.")
+	}
+}
+
+func TestCancelRequestsOnShutdown(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	started := make(chan struct{})
+	causes := make(chan error, 1)
+	server.HandleFunc("/cancelable", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			causes <- context.Cause(r.Context())
+		case <-time.After(5 * time.Second):
+			causes <- nil
+		}
+	})
+	server.CancelRequestsOnShutdown = true
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	go rawRequest(addrs[0], "/cancelable")
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to start.")
+	}
+
+	// Ensure that the handler observes the shutdown, and finishes early.
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.ShutdownContext(ctx); err != nil {
+		t.Fatalf("Expected no error when shutting down, received '%v'.", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the shutdown to finish early, took '%v'.", elapsed)
+	}
+	if cause := <-causes; cause != ErrShuttingDown {
+		t.Errorf("Expected the request to be canceled by the shutdown, received '%v'.", cause)
+	}
+}
+
+func TestStopAccepting(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start a long running request.
+	result := make(chan error, 1)
+	go func() {
+		result <- rawRequest(addrs[0], longRunningRoute)
+	}()
+	for i := 0; i < 100 && server.ActiveRequests() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ensure that new connections fail, while the request continues.
+	server.StopAccepting()
+	if err := rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Error("Expected new connections to fail once accepting stopped.")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Expected the request in flight to finish, received '%v'.", err)
+	}
+
+	// Ensure that shutting down afterwards finishes.
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down.")
+	}
+}
+
+func TestShutdownRetryAfter(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.ShutdownRetryAfter = 1500 * time.Millisecond
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+
+	// net/http stops reading from a connection once its server is shut
+	// down, so a request that arrives on a still-open connection while the
+	// listener is closing is simulated by handing it to the server directly.
+	listener := server.listeners.listeners[0]
+	listener.shutdown()
+	req, err := http.NewRequest("GET", "http://"+addrs[0]+simpleRoute, nil)
+	if err != nil {
+		t.Fatalf("Expected no error creating the request, received '%v'.", err)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), listenerContextKey{}, listener))
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+
+	// Ensure that the request is turned away, with a hint to retry.
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code 503, received '%v'.", recorder.Code)
+	}
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Expected a Retry-After of '2', received '%v'.", retryAfter)
+	}
+	if connection := recorder.Header().Get("Connection"); connection != "close" {
+		t.Errorf("Expected a Connection of 'close', received '%v'.", connection)
+	}
+
+	// Ensure that requests on listeners that are not shutting down are
+	// served as usual.
+	server.ShutdownRetryAfter = 0
+	if err := server.Listen(addrs[1]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for _, l := range server.listeners.listeners {
+		if l.address() == addrs[1] {
+			listener = l
+		}
+	}
+	req = req.WithContext(context.WithValue(context.Background(), listenerContextKey{}, listener))
+	recorder = httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status code 200, received '%v'.", recorder.Code)
+	}
+}
+
+func TestShutdownHijackedConnection(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	hijacked := make(chan net.Conn, 1)
+	server.ServeMux.HandleFunc("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		c, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		buf.Flush()
+		hijacked <- c
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT /hijack HTTP/1.1\r\nHost: %v\r\n\r\n", addrs[0])
+	var tunnel net.Conn
+	select {
+	case tunnel = <-hijacked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the connection to be hijacked.")
+	}
+
+	// Ensure that the hijacked connection is counted as an active request of
+	// its listener, and that shutting down waits for it, even though its
+	// handler has returned.
+	for i := 0; i < 100 && server.ActiveRequests() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if active := server.Stats().Listeners[addrs[0]].ActiveRequests; active != 1 {
+		t.Errorf("Expected 1 active request on the listener, received '%v'.", active)
+	}
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Expected shutdown to wait for the hijacked connection to close.")
+	case <-time.After(250 * time.Millisecond):
+	}
+	if _, err = tunnel.Write([]byte("still open")); err != nil {
+		t.Errorf("Expected no error writing to the hijacked connection, received '%v'.", err)
+	}
+	tunnel.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected shutdown to finish once the hijacked connection closed.")
+	}
+}
+
+func TestForceShutdown(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start a long running request.
+	result := make(chan error, 1)
+	go func() {
+		result <- rawRequest(addrs[0], longRunningRoute)
+	}()
+	for i := 0; i < 100 && server.ActiveRequests() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ensure that the connection is severed without waiting for the request.
+	start := time.Now()
+	server.ForceShutdown()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the forced shutdown to return quickly, took '%v'.", elapsed)
+	}
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("Expected the severed request to fail.")
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the connection to be dropped.")
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start a long running request.
+	go rawRequest(addrs[0], longRunningRoute)
+	time.Sleep(250 * time.Millisecond)
+
+	// Ensure that the context error is returned once the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := server.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected '%v', received '%v'.", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected shutdown to return shortly after the deadline, took '%v'.", elapsed)
+	}
+
+	// Ensure that the server is no longer accepting connections.
+	if err := rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Error("Expected the server to no longer accept connections.")
+	}
+
+	// Ensure that the drain completes given enough time.
+	if err := server.ShutdownContext(context.Background()); err != nil {
+		t.Errorf("Expected no error when shutting down, received '%v'.", err)
+	}
+}
+
+func TestOnDrainProgress(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	var mutex sync.Mutex
+	var reports, conns []int
+	server.OnDrainProgress = func(requests, connections int) {
+		mutex.Lock()
+		reports = append(reports, requests)
+		conns = append(conns, connections)
+		mutex.Unlock()
+	}
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start two long running requests, a second apart, so that they finish
+	// at different times.
+	for i := 0; i < 2; i++ {
+		go rawRequest(addrs[0], longRunningRoute)
+		for j := 0; j < 100 && server.ActiveRequests() <= i; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if i == 0 {
+			time.Sleep(1100 * time.Millisecond)
+		}
+	}
+	server.Shutdown()
+
+	// Ensure that the remaining requests were reported as they finished.
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(reports) < 2 || reports[0] != 2 || reports[len(reports)-1] != 1 {
+		t.Fatalf("Expected reports from 2 down to 1, received '%v'.", reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] > reports[i-1] {
+			t.Errorf("Expected decreasing reports, received '%v'.", reports)
+		}
+	}
+
+	// Ensure that the connections the requests were received on were
+	// reported along with them.
+	for i := range reports {
+		if conns[i] < reports[i] {
+			t.Errorf("Expected at least %v connections, received '%v'.", reports[i], conns[i])
+		}
+	}
+}
+
+func TestShutdownAll(t *testing.T) {
+	idle, busy := testServer(), testServer()
+	defer busy.Shutdown()
+
+	if err := idle.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err := busy.Listen(addrs[1]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	idle.Serve()
+	busy.Serve()
+
+	// Start a long running request on the second server.
+	go rawRequest(addrs[1], longRunningRoute)
+	for i := 0; i < 100 && busy.ActiveRequests() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ensure that only the server that exceeded the deadline is reported.
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	err := ShutdownAll(ctx, idle, busy)
+	errs, ok := err.(ShutdownErrors)
+	if !ok {
+		t.Fatalf("Expected ShutdownErrors, received '%v'.", err)
+	}
+	if len(errs) != 1 || errs[1] != context.DeadlineExceeded {
+		t.Errorf("Expected '%v' for the second server only, received '%v'.", context.DeadlineExceeded, err)
+	}
+
+	// Ensure that both servers are no longer accepting connections.
+	for _, addr := range addrs {
+		if err := rawRequest(addr, simpleRoute); err == nil {
+			t.Errorf("Expected %v to no longer accept connections.", addr)
+		}
+	}
+}
+
+func TestBarrier(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.ErrorWriter = ioutil.Discard
+	errDrain := errors.New("drain failed")
+	var drained []int
+	server.AddBarrier(barrierFunc(func(ctx context.Context) error {
+		drained = append(drained, server.ActiveRequests())
+		return errDrain
+	}))
+	server.AddBarrier(barrierFunc(func(ctx context.Context) error {
+		drained = append(drained, server.ActiveRequests())
+		return nil
+	}))
+	server.Serve()
+
+	// Start a long running request.
+	go rawRequest(addrs[0], longRunningRoute)
+	time.Sleep(250 * time.Millisecond)
+
+	// Ensure that every barrier is drained, after active requests have
+	// finished, and that the first error is returned.
+	if err := server.ShutdownContext(context.Background()); err != errDrain {
+		t.Errorf("Expected '%v', received '%v'.", errDrain, err)
+	}
+	if len(drained) != 2 {
+		t.Fatalf("Expected 2 barriers to be drained, received '%v'.", len(drained))
+	}
+	for i, active := range drained {
+		if active != 0 {
+			t.Errorf("Expected barrier %v to be drained with no active requests, received '%v'.", i, active)
+		}
+	}
+}
+
+// barrierFunc is an adapter to allow the use of ordinary functions as
+// barriers.
+type barrierFunc func(ctx context.Context) error
+
+// Drain implements the Drain() method of the Barrier interface.
+func (f barrierFunc) Drain(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestShutdownDependency(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	if err = server.ShutdownDependency(addrs[0], addrs[1]); err != nil {
+		t.Fatalf("Expected no error when declaring a dependency, received '%v'.", err)
+	}
+	if err = server.ShutdownDependency(addrs[1], addrs[0]); err == nil {
+		t.Fatal("Expected an error when declaring a dependency cycle.")
+	}
+	server.Serve()
+
+	// Start a long running request on the dependent listener, and begin
+	// shutting down.
+	go rawRequest(addrs[0], longRunningRoute)
+	time.Sleep(250 * time.Millisecond)
+	shutdown := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(shutdown)
+	}()
+	time.Sleep(250 * time.Millisecond)
+
+	// Ensure that only the dependent listener has been closed.
+	if err = rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Errorf("Expected %v to no longer accept connections.", addrs[0])
+	}
+	if err = rawRequest(addrs[1], simpleRoute); err != nil {
+		t.Error(err)
+	}
+
+	// Ensure that the dependency is closed once the dependent has drained.
+	<-shutdown
+	if err = rawRequest(addrs[1], simpleRoute); err == nil {
+		t.Errorf("Expected %v to no longer accept connections.", addrs[1])
+	}
+}
+
+func TestActiveRequests(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that an in-flight request is counted.
+	result := make(chan error, 1)
+	go func() {
+		result <- rawRequest(addrs[0], longRunningRoute)
+	}()
+	time.Sleep(250 * time.Millisecond)
+	if active := server.ActiveRequests(); active != 1 {
+		t.Errorf("Expected one active request, received '%v'.", active)
+	}
+
+	// Ensure that the request is no longer counted once it has completed.
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if active := server.ActiveRequests(); active != 0 {
+		t.Errorf("Expected no active requests, received '%v'.", active)
+	}
+}
+
+func TestServeError(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+
+	// Break the first listener behind the server's back.
+	server.listeners.listeners[0].Listener.Close()
+
+	// Ensure that the broken listener is reported.
+	err = server.Serve()
+	serveErrs, ok := err.(ServeErrors)
+	if !ok {
+		t.Fatalf("Expected a ServeErrors error, received '%v'.", err)
+	}
+	if _, exists := serveErrs[addrs[0]]; !exists || len(serveErrs) != 1 {
+		t.Fatalf("Expected an error for only %v, received '%v'.", addrs[0], err)
+	}
+
+	// Ensure that the healthy listener is still serving connections.
+	if err = rawRequest(addrs[1], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	failedAddrs := make(chan string, 1)
+	server.ErrorHandler = func(addr string, err error) {
+		failedAddrs <- addr
+	}
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	if err = server.Serve(); err != nil {
+		t.Fatalf("Expected no error when serving, received '%v'.", err)
+	}
+
+	// Break the first listener while it is serving connections.
+	server.listeners.listeners[0].Listener.Close()
+
+	// Ensure that the error handler is called with the right address.
+	select {
+	case addr := <-failedAddrs:
+		if addr != addrs[0] {
+			t.Errorf("Expected error handler to be called for %v, received '%v'.", addrs[0], addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected error handler to be called.")
+	}
+
+	// Ensure that the other listener is still serving connections.
+	if err = rawRequest(addrs[1], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	errs := server.Errors()
+	if server.Errors() != errs {
+		t.Error("Expected every call to return the same channel.")
+	}
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	if err = server.Serve(); err != nil {
+		t.Fatalf("Expected no error when serving, received '%v'.", err)
+	}
+
+	// Break the first listener while it is serving connections.
+	server.listeners.listeners[0].Listener.Close()
+
+	// Ensure that the error is sent with the right address.
+	select {
+	case listenerErr := <-errs:
+		if listenerErr.Addr != addrs[0] {
+			t.Errorf("Expected an error for %v, received '%v'.", addrs[0], listenerErr.Addr)
+		}
+		if listenerErr.Err == nil {
+			t.Error("Expected the error to be set.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected an error to be sent.")
+	}
+}
+
+func TestConnectionQueue(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.MaxConnections = 1
+	server.ConnectionQueueTimeout = 500 * time.Millisecond
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that a queued connection is served once capacity frees up.
+	held, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	go func(c net.Conn) {
+		time.Sleep(100 * time.Millisecond)
+		c.Close()
+	}(held)
+	if err = rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that a queued connection is rejected once the timeout expires.
+	held, err = net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer held.Close()
+	if err = rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Fatal("Expected the queued connection to be rejected.")
+	}
+}
+
+func TestConnectionQueueWaitsPerConnection(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.MaxConnections = 1
+	server.ConnectionQueueTimeout = 500 * time.Millisecond
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	held, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer held.Close()
+
+	// Ensure that connections are queued at the same time, rather than one
+	// after the other.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rawRequest(addrs[0], simpleRoute); err == nil {
+				t.Error("Expected the queued connection to be rejected.")
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed >= 2*server.ConnectionQueueTimeout {
+		t.Errorf("Expected the queued connections to time out together, took '%v'.", elapsed)
+	}
+}
+
+func TestMaxQueuedConnections(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	server.MaxConnections = 1
+	server.ConnectionQueueTimeout = time.Second
+	server.MaxQueuedConnections = 1
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	held, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer held.Close()
+	queued := make(chan error, 1)
+	go func() {
+		queued <- rawRequest(addrs[0], simpleRoute)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Ensure that a connection is rejected immediately once the queue is full.
+	start := time.Now()
+	if err = rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Error("Expected the connection to be rejected.")
+	}
+	if elapsed := time.Since(start); elapsed >= server.ConnectionQueueTimeout/2 {
+		t.Errorf("Expected the connection to be rejected without waiting, took '%v'.", elapsed)
+	}
+
+	// Ensure that the queued connection is still served.
+	held.Close()
+	if err = <-queued; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnectionQueueShutdown(t *testing.T) {
+	var err error
+	server := testServer()
+
+	server.MaxConnections = 1
+	server.ConnectionQueueTimeout = time.Minute
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	held, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer held.Close()
+	queued, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer queued.Close()
+	if _, err = queued.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")); err != nil {
+		t.Fatalf("Expected no error when writing, received '%v'.", err)
+	}
+
+	// Ensure that a queued connection is closed when the server shuts down,
+	// rather than waiting for capacity.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.ShutdownWithTimeout(time.Second)
+	}()
+	queued.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err = queued.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the queued connection to be closed.")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("Expected the queued connection to be closed, received '%v'.", err)
+	}
+	held.Close()
+	<-done
+}
+
+func TestLogger(t *testing.T) {
+	var err error
+	server := testServer()
+
+	logs := &lockedBuffer{}
+	server.Logger = log.New(logs, "", 0)
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that a failed TLS handshake is logged.
+	if err = rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Error("Expected a plain HTTP request to a TLS listener to fail.")
+	}
+	for i := 0; i < 100 && !strings.Contains(logs.String(), "TLS handshake error"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "TLS handshake error") {
+		t.Errorf("Expected the TLS handshake error to be logged, received '%v'.", logs.String())
+	}
+
+	// Ensure that shutdown events are logged.
+	server.Shutdown()
+	for _, event := range []string{"shutdown started", "shutdown completed"} {
+		if !strings.Contains(logs.String(), event) {
+			t.Errorf("Expected '%v' to be logged, received '%v'.", event, logs.String())
+		}
+	}
+}
+
+func TestConnState(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	states := make(chan http.ConnState, 10)
+	server.ConnState = func(c net.Conn, state http.ConnState) {
+		states <- state
+	}
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Make a single keep-alive request, and then close the connection.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	fmt.Fprintf(c, "GET %v HTTP/1.1\r\nHost: %v\r\n\r\n", simpleRoute, addrs[0])
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	resp.Body.Close()
+	c.Close()
+
+	// Ensure that each state transition was reported, in order.
+	expected := []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateClosed}
+	for _, state := range expected {
+		select {
+		case received := <-states:
+			if received != state {
+				t.Fatalf("Expected state '%v', received '%v'.", state, received)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected state '%v', received none.", state)
+		}
+	}
+}
+
+func TestSetMaxConns(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	release := make(chan struct{})
+	server.ServeMux.HandleFunc("/block", func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintln(w, "Success")
+	})
+	server.SetMaxConns(1)
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Start a request that holds the only available connection.
+	first := make(chan error, 1)
+	go func() {
+		first <- rawRequest(addrs[0], "/block")
+	}()
+	for i := 0; i < 100 && server.ActiveRequests() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ensure that a second request queues until the first finishes.
+	second := make(chan error, 1)
+	go func() {
+		second <- rawRequest(addrs[0], simpleRoute)
+	}()
+	select {
+	case err := <-second:
+		t.Fatalf("Expected the second request to queue, received '%v'.", err)
+	case <-time.After(250 * time.Millisecond):
+	}
+	close(release)
+	for i, done := range []chan error{first, second} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expected request %v to succeed, received '%v'.", i+1, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected request %v to finish.", i+1)
+		}
+	}
+}
+
+func TestShutdownWebhook(t *testing.T) {
+	events := make(chan shutdownEvent, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event shutdownEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("Expected no error decoding shutdown event, received '%v'.", err)
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+
+	server := testServer()
+	server.ShutdownWebhook(webhook.URL)
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+	server.Shutdown()
+
+	// Ensure that both the start and completion of shutdown were reported.
+	// Delivery is asynchronous, so the events may arrive after shutdown.
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			received[event.Event] = true
+		case <-time.After(shutdownWebhookTimeout):
+			t.Fatalf("Expected two shutdown events, received '%v'.", i)
+		}
+	}
+	for _, event := range []string{"shutdown_started", "shutdown_completed"} {
+		if !received[event] {
+			t.Errorf("Expected a '%v' shutdown event.", event)
+		}
+	}
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	server := testServer()
+
+	// Ensure that the net/http default is used unless a limit is set.
+	if config := server.http2Config(); config != nil {
+		t.Errorf("Expected no HTTP/2 configuration, received '%v'.", config)
+	}
+	server.MaxConcurrentStreams = 1
+	if config := server.http2Config(); config == nil || config.MaxConcurrentStreams != 1 {
+		t.Errorf("Expected a limit of one stream, received '%v'.", config)
+	}
+}
+
+func TestShutdownWebhookDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer webhook.Close()
+	defer close(release)
+
+	server := testServer()
+	server.ShutdownWebhook(webhook.URL)
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that an unresponsive webhook does not delay shutdown.
+	start := time.Now()
+	if err := server.ShutdownWithTimeout(500 * time.Millisecond); err != nil {
+		t.Fatalf("Expected no error when shutting down, received '%v'.", err)
+	}
+	if elapsed := time.Since(start); elapsed >= shutdownWebhookTimeout {
+		t.Errorf("Expected shutdown to not wait for the webhook, took '%v'.", elapsed)
+	}
+}
+
+// tlsHandshake performs a TLS handshake, over a new connection, with the given
+// server.
+func tlsHandshake(addr, serverName string) error {
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName: serverName,
+		RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// peerCommonName performs a TLS handshake, over a new connection, with the given
+// server, and returns the common name of the certificate it presented.
+func peerCommonName(addr string) (string, error) {
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs: httpTransport.TLSClientConfig.RootCAs,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+// tlsVersionHandshake performs a TLS handshake, over a new connection and using
+// only the provided TLS version, with the given server.
+func tlsVersionHandshake(addr string, version uint16) error {
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+		MinVersion: version,
+		MaxVersion: version,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// rawRequest makes a plain HTTP/1.0 request over a new connection to the given
+// server.
+func rawRequest(addr, route string) error {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Expected no error when connecting to %v, received '%v'.", addr, err)
+	}
+	defer c.Close()
+	return connRequest(c, route)
+}
+
+// unixRequest makes a plain HTTP/1.0 request over the Unix socket at path.
+func unixRequest(path, route string) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("Expected no error when connecting to %v, received '%v'.", path, err)
+	}
+	defer c.Close()
+	return connRequest(c, route)
+}
+
+// connRequest makes a plain HTTP/1.0 request over the given connection.
+func connRequest(c net.Conn, route string) error {
+	addr, host := c.RemoteAddr().String(), c.RemoteAddr().String()
+	if _, ok := c.RemoteAddr().(*net.UnixAddr); ok {
+		host = "localhost"
+	}
+	fmt.Fprintf(c, "GET %v HTTP/1.0\r\nHost: %v\r\n\r\n", route, host)
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return fmt.Errorf("Expected no error reading from %v, received '%v'.", addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Expected status code 200 from %v, received '%v'.", addr, resp.StatusCode)
+	}
+	return nil
+}
+
+// pipeListener is an in-memory implementation of the net.Listener interface.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newPipeListener creates a new pipeListener.
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// listen implements the Server.ListenFunc function.
+func (p *pipeListener) listen(network, addr string) (net.Listener, error) {
+	return p, nil
+}
+
+// dial creates a new connection to the listener.
+func (p *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case p.conns <- server:
+		return client, nil
+	case <-p.closed:
+		return nil, errPipeClosed
+	}
+}
+
+// Accept implements the Accept() method of the net.Listener interface.
+func (p *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-p.conns:
+		return c, nil
+	case <-p.closed:
+		return nil, errPipeClosed
+	}
+}
+
+// Close implements the Close() method of the net.Listener interface.
+func (p *pipeListener) Close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+// Addr implements the Addr() method of the net.Listener interface.
+func (p *pipeListener) Addr() net.Addr { return pipeAddr{} }
+
+// pipeAddr is an implementation of the net.Addr interface.
+type pipeAddr struct{}
+
+// Network implements the Network() method of the net.Addr interface.
+func (pipeAddr) Network() string { return "pipe" }
+
+// String implements the String() method of the net.Addr interface.
+func (pipeAddr) String() string { return "pipe" }
+
+// errPipeClosed is the error returned when using a closed pipeListener.
+var errPipeClosed = errors.New("pipe listener closed")
+
+// flakyListener is an implementation of the net.Listener interface that fails
+// to accept with a temporary error a number of times before accepting.
+type flakyListener struct {
+	net.Listener
+	mutex    sync.Mutex
+	failures int
+}
+
+// Accept implements the Accept() method of the net.Listener interface.
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mutex.Lock()
+	if l.failures > 0 {
+		l.failures--
+		l.mutex.Unlock()
+		return nil, temporaryError{}
+	}
+	l.mutex.Unlock()
+	return l.Listener.Accept()
+}
+
+// remaining returns the number of temporary errors left to return.
+func (l *flakyListener) remaining() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.failures
+}
+
+// temporaryError is an implementation of the net.Error interface that is
+// temporary.
+type temporaryError struct{}
+
+// Error implements the Error() method of the error interface.
+func (temporaryError) Error() string { return "temporary error" }
+
+// Timeout implements the Timeout() method of the net.Error interface.
+func (temporaryError) Timeout() bool { return false }
+
+// Temporary implements the Temporary() method of the net.Error interface.
+func (temporaryError) Temporary() bool { return true }
+
 // request makes a request to the given server.
 func request(tls bool, addr, serverName, route string, expectSuccess bool) error {
 	var url string
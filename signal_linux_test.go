@@ -0,0 +1,53 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeUntilSignal(t *testing.T) {
+	server := testServer()
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeUntilSignal(syscall.SIGUSR1)
+	}()
+	for i := 0; i < 100; i++ {
+		if err := rawRequest(addrs[0], simpleRoute); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Start a long running request, and then signal the server.
+	result := make(chan error, 1)
+	go func() {
+		result <- rawRequest(addrs[0], longRunningRoute)
+	}()
+	time.Sleep(250 * time.Millisecond)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Expected no error when signaling, received '%v'.", err)
+	}
+
+	// Ensure that the server shut down, and that the request was allowed to
+	// finish.
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected no error from ServeUntilSignal, received '%v'.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ServeUntilSignal to return after the signal.")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Expected the long running request to succeed, received '%v'.", err)
+	}
+}
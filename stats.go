@@ -0,0 +1,138 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// RejectionReason describes why a connection was rejected.
+type RejectionReason int
+
+// Rejection reasons.
+const (
+	// RejectedMaxConnections means the connection was rejected immediately
+	// because MaxConnections had been reached.
+	RejectedMaxConnections RejectionReason = iota
+	// RejectedQueueTimeout means the connection was queued because
+	// MaxConnections had been reached, and ConnectionQueueTimeout expired
+	// before capacity freed up.
+	RejectedQueueTimeout
+	// RejectedNotAllowed means the connection came from an address outside
+	// of the ranges set by SetAllowedCIDRs.
+	RejectedNotAllowed
+
+	// numRejectionReasons is the number of rejection reasons, and must
+	// remain last.
+	numRejectionReasons
+)
+
+// String implements the String() method of the fmt.Stringer interface.
+func (r RejectionReason) String() string {
+	switch r {
+	case RejectedMaxConnections:
+		return "max connections"
+	case RejectedQueueTimeout:
+		return "queue timeout"
+	case RejectedNotAllowed:
+		return "not allowed"
+	}
+	return "RejectionReason(" + strconv.Itoa(int(r)) + ")"
+}
+
+// ServerStats is a snapshot of the server's activity.
+type ServerStats struct {
+	// Goroutines is the number of goroutines running on behalf of the
+	// server, including accept loops, background tasks, and one for each
+	// active connection.
+	Goroutines int
+	// Rejections is the number of connections that have been rejected, by
+	// reason.  Reasons with no rejections are omitted.
+	Rejections map[RejectionReason]int64
+	// AcceptedConnections is the number of connections that have been
+	// accepted, and ActiveConnections the number that are still open.
+	// Rejected connections are not counted.
+	AcceptedConnections int64
+	ActiveConnections   int
+	// ServedRequests is the number of requests that have been served, and
+	// ActiveRequests the number that are still being served.
+	ServedRequests int64
+	ActiveRequests int
+	// Listeners breaks down the activity of each listener that is currently
+	// managed, by address.
+	Listeners map[string]ListenerStats
+	// Protocols is the number of TLS connections that have become active, by
+	// the protocol negotiated via ALPN, such as "h2" or "http/1.1".
+	// Connections that did not negotiate a protocol are counted under the
+	// empty string.  Handlers can find the protocol negotiated for their own
+	// connection in the request's TLS connection state.
+	Protocols map[string]int64
+}
+
+// ListenerStats is a snapshot of a single listener's activity.
+type ListenerStats struct {
+	AcceptedConnections int64
+	ActiveConnections   int64
+	ServedRequests      int64
+	ActiveRequests      int
+}
+
+// Stats returns a snapshot of the server's activity.
+func (s *Server) Stats() ServerStats {
+	s.listeners.connsMutex.Lock()
+	activeConns := len(s.listeners.conns)
+	s.listeners.connsMutex.Unlock()
+
+	stats := ServerStats{
+		Goroutines:          s.listeners.goroutineCount(),
+		Rejections:          make(map[RejectionReason]int64),
+		AcceptedConnections: atomic.LoadInt64(&s.listeners.acceptedConns),
+		ActiveConnections:   activeConns,
+		ServedRequests:      atomic.LoadInt64(&s.listeners.servedRequests),
+		ActiveRequests:      int(atomic.LoadInt64(&s.listeners.activeRequests)),
+		Listeners:           s.listeners.stats(),
+		Protocols:           s.listeners.protocolStats(),
+	}
+	for reason := RejectionReason(0); reason < numRejectionReasons; reason++ {
+		if count := atomic.LoadInt64(&s.listeners.rejections[reason]); count > 0 {
+			stats.Rejections[reason] = count
+		}
+	}
+	return stats
+}
+
+// protocolStats returns a snapshot of the number of TLS connections, by the
+// protocol negotiated via ALPN.
+func (l *listeners) protocolStats() map[string]int64 {
+	l.protocolsMutex.Lock()
+	defer l.protocolsMutex.Unlock()
+
+	protocols := make(map[string]int64, len(l.protocols))
+	for protocol, count := range l.protocols {
+		protocols[protocol] = count
+	}
+	return protocols
+}
+
+// stats returns a snapshot of each listener's activity, by address.
+func (l *listeners) stats() map[string]ListenerStats {
+	l.RLock()
+	defer l.RUnlock()
+
+	stats := make(map[string]ListenerStats, len(l.listeners))
+	for _, listener := range l.listeners {
+		listener.requestsMutex.Lock()
+		activeRequests := listener.requests
+		listener.requestsMutex.Unlock()
+		stats[listener.address()] = ListenerStats{
+			AcceptedConnections: atomic.LoadInt64(&listener.acceptedConns),
+			ActiveConnections:   atomic.LoadInt64(&listener.activeConns),
+			ServedRequests:      atomic.LoadInt64(&listener.servedRequests),
+			ActiveRequests:      activeRequests,
+		}
+	}
+	return stats
+}
@@ -0,0 +1,211 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsGoroutines(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	logs := &lockedBuffer{}
+	server.ErrorWriter = logs
+	server.GoroutineWarningThreshold = len(addrs)
+	for _, addr := range addrs {
+		if err := server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Ensure that each accept loop is counted.
+	if goroutines := server.Stats().Goroutines; goroutines != len(addrs) {
+		t.Errorf("Expected %v goroutines, received '%v'.", len(addrs), goroutines)
+	}
+	if logs.String() != "" {
+		t.Errorf("Expected no warning, received '%v'.", logs.String())
+	}
+
+	// Ensure that an active connection is counted, and crosses the threshold.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	time.Sleep(100 * time.Millisecond)
+	if goroutines := server.Stats().Goroutines; goroutines != len(addrs)+1 {
+		t.Errorf("Expected %v goroutines, received '%v'.", len(addrs)+1, goroutines)
+	}
+	if !strings.Contains(logs.String(), "exceeding the threshold") {
+		t.Errorf("Expected a warning, received '%v'.", logs.String())
+	}
+}
+
+func TestStatsRejections(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	rejected := make(chan RejectionReason, 2)
+	server.OnConnectionRejected = func(remoteAddr string, reason RejectionReason) {
+		rejected <- reason
+	}
+	server.MaxConnections = 1
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Hold the only available connection, and then attempt another.
+	held, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer held.Close()
+	if err = rawRequest(addrs[0], simpleRoute); err == nil {
+		t.Fatal("Expected the connection to be rejected.")
+	}
+
+	// Ensure that the rejection was reported and counted.
+	select {
+	case reason := <-rejected:
+		if reason != RejectedMaxConnections {
+			t.Errorf("Expected rejection reason '%v', received '%v'.", RejectedMaxConnections, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the rejection to be reported.")
+	}
+	rejections := server.Stats().Rejections
+	if len(rejections) != 1 || rejections[RejectedMaxConnections] != 1 {
+		t.Errorf("Expected 1 rejection for '%v', received '%v'.", RejectedMaxConnections, rejections)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+// Write implements the Write() method of the io.Writer interface.
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+// String returns the contents of the buffer.
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestStatsCounters(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err := server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	server.Serve()
+
+	// Serve a few requests, each over its own connection.
+	for i := 0; i < 3; i++ {
+		if err := rawRequest(addrs[0], simpleRoute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rawRequest(addrs[1], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold a connection open, and wait for the others to be closed.
+	held, err := net.Dial("tcp", addrs[1])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer held.Close()
+	var stats ServerStats
+	for i := 0; i < 100; i++ {
+		if stats = server.Stats(); stats.AcceptedConnections == 5 && stats.ActiveConnections == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Ensure that the counters add up, in total and for each listener.
+	if stats.AcceptedConnections != 5 || stats.ActiveConnections != 1 {
+		t.Errorf("Expected 5 accepted and 1 active connection, received '%v' and '%v'.",
+			stats.AcceptedConnections, stats.ActiveConnections)
+	}
+	if stats.ServedRequests != 4 || stats.ActiveRequests != 0 {
+		t.Errorf("Expected 4 served and 0 active requests, received '%v' and '%v'.",
+			stats.ServedRequests, stats.ActiveRequests)
+	}
+	expected := map[string]ListenerStats{
+		addrs[0]: {AcceptedConnections: 3, ActiveConnections: 0, ServedRequests: 3},
+		addrs[1]: {AcceptedConnections: 2, ActiveConnections: 1, ServedRequests: 1},
+	}
+	for addr, want := range expected {
+		if got := stats.Listeners[addr]; got != want {
+			t.Errorf("Expected stats %+v for %v, received '%+v'.", want, addr, got)
+		}
+	}
+}
+
+func TestStatsProtocols(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.EnableHTTP2()
+	server.Serve()
+
+	// Make a request over HTTP/2, and another over HTTP/1.1.
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			ServerName: "srv1.localhost",
+			RootCAs:    httpTransport.TLSClientConfig.RootCAs,
+		},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("https://" + addrs[0] + simpleRoute)
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Expected HTTP/2 to be negotiated, received '%v'.", resp.Proto)
+	}
+	if err = httpsRequestSuccess(addrs[0], "srv1.localhost", simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that each connection is counted by its protocol.  The HTTP/1.1
+	// client does not offer any protocols, so none was negotiated.
+	protocols := server.Stats().Protocols
+	if protocols["h2"] != 1 || protocols[""] != 1 {
+		t.Errorf("Expected one h2 connection, and one without a protocol, received '%v'.", protocols)
+	}
+}
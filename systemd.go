@@ -0,0 +1,71 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFD is the descriptor of the first socket passed by systemd.
+const systemdFirstFD = 3
+
+// ListenSystemd adopts the sockets passed to the process by systemd socket
+// activation, as described by the LISTEN_PID, LISTEN_FDS, and LISTEN_FDNAMES
+// environment variables.  The environment variables are removed, so that the
+// sockets are not adopted again by processes that this process starts.  If
+// any socket can not be adopted, those that were already adopted are closed,
+// and an error is returned.
+func (s *Server) ListenSystemd() error {
+	return s.listenSystemd(systemdFirstFD)
+}
+
+// listenSystemd adopts the sockets passed by systemd, which begin at the
+// provided descriptor.
+func (s *Server) listenSystemd(firstFD int) error {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid == "" || fds == "" {
+		return errors.New("server: no sockets were passed by systemd")
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return fmt.Errorf("server: sockets were passed by systemd to process %v", pid)
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return fmt.Errorf("server: invalid LISTEN_FDS %q", fds)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	adopted := make([]*listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(firstFD+i)
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		file := os.NewFile(uintptr(firstFD+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, l := range adopted {
+				l.shutdown()
+				s.listeners.unmanage(l)
+			}
+			return fmt.Errorf("server: failed to adopt systemd socket %v: %w", name, err)
+		}
+		adopted = append(adopted, s.listeners.manage(l))
+	}
+	return nil
+}
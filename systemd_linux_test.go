@@ -0,0 +1,73 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenSystemd(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	// Without the environment variables, there is nothing to adopt.
+	if err := server.ListenSystemd(); err == nil {
+		t.Error("Expected an error when no sockets were passed.")
+	}
+
+	// Pass a socket that was opened by someone else, as systemd would.
+	l, err := net.Listen("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	fd := systemdTestFD(t, l)
+	l.Close()
+
+	// Ensure that sockets passed to another process are ignored.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	if err = server.listenSystemd(fd); err == nil {
+		t.Error("Expected an error when the sockets were passed to another process.")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_FDNAMES", "http")
+	if err = server.listenSystemd(fd); err != nil {
+		t.Fatalf("Expected no error when adopting sockets, received '%v'.", err)
+	}
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(name); ok {
+			t.Errorf("Expected %v to be removed from the environment.", name)
+		}
+	}
+	server.Serve()
+
+	// Ensure that the adopted socket is serving requests.
+	if err = rawRequest(addrs[0], simpleRoute); err != nil {
+		t.Error(err)
+	}
+}
+
+// systemdTestFD returns a duplicate of the listener's descriptor, which is not
+// owned by an os.File.
+func systemdTestFD(t *testing.T, l net.Listener) int {
+	raw, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatalf("Expected no error accessing the socket, received '%v'.", err)
+	}
+	fd := -1
+	raw.Control(func(s uintptr) {
+		fd, err = syscall.Dup(int(s))
+	})
+	if err != nil {
+		t.Fatalf("Expected no error duplicating the socket, received '%v'.", err)
+	}
+	return fd
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// SetConnRateLimit limits the throughput of each connection to bytesPerSec
+// bytes per second, in each direction, with bursts of up to a second's worth.
+// This can be used to enforce fair use, or to test how handlers behave with
+// slow clients.  The limit is applied to the connection itself, so the bytes
+// of TLS records and headers count towards it, and waiting for the limit is
+// not bounded by the connection's deadlines.  It applies to connections
+// accepted afterwards, and a limit of zero or less removes it.
+func (s *Server) SetConnRateLimit(bytesPerSec int) {
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	atomic.StoreInt64(&s.listeners.connRateLimit, int64(bytesPerSec))
+}
+
+// readThrottled reads from the connection, waiting as necessary to keep within
+// the connection's rate limit, if any.
+func (c *conn) readThrottled(b []byte) (int, error) {
+	if c.readLimiter == nil {
+		return c.Conn.Read(b)
+	}
+
+	// The bytes are waited for once they have been read, as how many will
+	// arrive is not known in advance.
+	if burst := c.readLimiter.Burst(); len(b) > burst {
+		b = b[:burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.readLimiter.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+// writeThrottled writes to the connection, waiting as necessary to keep within
+// the connection's rate limit, if any.
+func (c *conn) writeThrottled(b []byte) (int, error) {
+	if c.writeLimiter == nil {
+		return c.Conn.Write(b)
+	}
+
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if burst := c.writeLimiter.Burst(); len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		c.writeLimiter.WaitN(context.Background(), len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
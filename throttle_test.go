@@ -0,0 +1,49 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSetConnRateLimit(t *testing.T) {
+	const bytesPerSec = 16 * 1024
+	server := testServer()
+	defer server.Shutdown()
+
+	payload := bytes.Repeat([]byte("a"), 2*bytesPerSec)
+	server.ServeMux.HandleFunc("/payload", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	})
+	server.SetConnRateLimit(bytesPerSec)
+	if err := server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// The first second's worth is sent immediately, so the rest should take
+	// about a second.
+	start := time.Now()
+	resp, err := http.Get("http://" + addrs[0] + "/payload")
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("Expected no error reading the body, received '%v'.", err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("Expected a %v byte payload, received %v bytes.", len(payload), len(body))
+	}
+	if elapsed < 900*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the transfer to take about a second, took '%v'.", elapsed)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+)
+
+// sessionTicketKeyCount is the number of session ticket keys each listener
+// keeps.  The newest key encrypts new tickets, and the older keys remain valid
+// for resuming sessions, so a ticket survives this many rotations, less one.
+const sessionTicketKeyCount = 3
+
+// RotateSessionTicketKeys gives each listener a new, randomly generated,
+// session ticket key, which is used to encrypt new session tickets.  The
+// previous keys remain valid for resuming sessions until they have been
+// rotated out by later rotations.  Listeners with their own TLS configuration
+// are not affected.
+func (s *Server) RotateSessionTicketKeys() {
+	s.listeners.rotateSessionTicketKeys()
+}
+
+// SetSessionTicketKeys sets the keys used to encrypt and decrypt session
+// tickets, for current and future listeners.  The first key encrypts new
+// tickets, and all of them are used to decrypt tickets.  Giving servers the
+// same keys allows clients to resume sessions with any of them, such as when
+// they are behind a load balancer.  However, anyone holding the keys can
+// decrypt the traffic of any session that used a ticket encrypted with them,
+// so the keys must be kept secret and rotated regularly; if any server is
+// compromised, sessions with all of them are.  Listeners that are already
+// serving TLS connections switch to the keys immediately, so tickets they
+// issued with their previous keys can no longer be used to resume.  Keys are
+// not rotated automatically, and rotating them with RotateSessionTicketKeys
+// replaces them with keys unique to each listener.
+// Without any keys, this does nothing.
+func (s *Server) SetSessionTicketKeys(keys ...[32]byte) {
+	if len(keys) == 0 {
+		return
+	}
+
+	s.tlsMutex.Lock()
+	defer s.tlsMutex.Unlock()
+
+	if s.TLS == nil {
+		s.TLS = s.initialTLSConfiguration()
+	}
+	s.TLS.SetSessionTicketKeys(keys)
+	s.listeners.clearSessionTicketKeys()
+	s.listeners.reloadTLS(s.TLS)
+}
+
+// SetSessionTicketKeyRotation rotates session ticket keys, as with
+// RotateSessionTicketKeys, on the provided interval.  Rotation stops when the
+// server is shut down, or when this is called again; an interval of zero only
+// stops it.
+func (s *Server) SetSessionTicketKeyRotation(d time.Duration) {
+	s.ticketMutex.Lock()
+	defer s.ticketMutex.Unlock()
+
+	if s.stopTickets != nil {
+		s.stopTickets()
+		s.stopTickets = nil
+	}
+	if d <= 0 {
+		return
+	}
+
+	// Stopping waits for a rotation in progress, so that no rotation happens
+	// once stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.stopTickets = func() {
+		cancel()
+		<-done
+	}
+	s.listeners.spawn(func() {
+		defer close(done)
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.RotateSessionTicketKeys()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// stopRotatingSessionTicketKeys stops rotating session ticket keys, if it was
+// started.
+func (s *Server) stopRotatingSessionTicketKeys() {
+	s.ticketMutex.Lock()
+	defer s.ticketMutex.Unlock()
+
+	if s.stopTickets != nil {
+		s.stopTickets()
+		s.stopTickets = nil
+	}
+}
+
+// rotateSessionTicketKeys gives each listener without its own TLS
+// configuration a new session ticket key.
+func (l *listeners) rotateSessionTicketKeys() {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, listener := range l.listeners {
+		if err := listener.rotateSessionTicketKey(); err != nil {
+			l.server.logf("server: failed to rotate session ticket key for %v: %v", listener.address(), err)
+		}
+	}
+}
+
+// clearSessionTicketKeys discards the rotated session ticket keys of each
+// listener, so that they use the server's keys instead.
+func (l *listeners) clearSessionTicketKeys() {
+	l.RLock()
+	defer l.RUnlock()
+
+	for _, listener := range l.listeners {
+		listener.tlsMutex.Lock()
+		if !listener.ownTLS {
+			listener.ticketKeys = nil
+			listener.ticketFallback = nil
+		}
+		listener.tlsMutex.Unlock()
+	}
+}
+
+// rotateSessionTicketKey generates a new session ticket key for the listener,
+// and keeps the most recent of its previous keys for resuming sessions.
+func (l *listener) rotateSessionTicketKey() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+
+	l.tlsMutex.Lock()
+	defer l.tlsMutex.Unlock()
+
+	if l.ownTLS {
+		return nil
+	}
+	if len(l.ticketKeys) == 0 {
+		// The keys in use until now, whether the server's or generated by
+		// crypto/tls, can not be read back, so the configuration holding
+		// them is kept to decrypt the tickets they issued.
+		l.ticketFallback = l.tlsConfig
+	}
+	keys := append([][32]byte{key}, l.ticketKeys...)
+	if len(keys) >= sessionTicketKeyCount {
+		keys = keys[:sessionTicketKeyCount]
+		l.ticketFallback = nil
+	}
+	l.ticketKeys = keys
+	// The configuration may be in use by handshakes, so a new one is used.
+	l.tlsConfig = l.tlsConfig.Clone()
+	l.applySessionTicketKeys()
+	return nil
+}
+
+// applySessionTicketKeys sets the listener's rotated session ticket keys, if
+// any, on its TLS configuration, along with the keys it used before they were
+// first rotated, which only decrypt tickets.  The caller must hold tlsMutex for
+// writing.
+func (l *listener) applySessionTicketKeys() {
+	if len(l.ticketKeys) == 0 {
+		return
+	}
+	config, fallback := l.tlsConfig, l.ticketFallback
+	config.SetSessionTicketKeys(l.ticketKeys)
+	config.UnwrapSession = nil
+	if fallback != nil {
+		config.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+			if session, err := config.DecryptTicket(identity, cs); session != nil || err != nil {
+				return session, err
+			}
+			return fallback.DecryptTicket(identity, cs)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestRotateSessionTicketKeys(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that sessions from before the first rotation can be resumed
+	// after it.
+	cache := tls.NewLRUClientSessionCache(1)
+	if _, err = resumedHandshake(addrs[0], cache); err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	server.RotateSessionTicketKeys()
+	if resumed, err := resumedHandshake(addrs[0], cache); err != nil || !resumed {
+		t.Errorf("Expected the session to be resumed after the first rotation, received '%v' ('%v').", resumed, err)
+	}
+
+	// Ensure that rotation changes the active key.
+	server.RotateSessionTicketKeys()
+	listener := server.listeners.listeners[0]
+	listener.tlsMutex.RLock()
+	first := listener.ticketKeys[0]
+	listener.tlsMutex.RUnlock()
+	server.RotateSessionTicketKeys()
+	listener.tlsMutex.RLock()
+	second := listener.ticketKeys[0]
+	listener.tlsMutex.RUnlock()
+	if first == second {
+		t.Error("Expected the session ticket key to change when rotated.")
+	}
+
+	// Ensure that sessions can be resumed across a rotation, but not once
+	// the key they were issued with has been rotated out.  Resuming a session
+	// may issue a new ticket, so each check uses a session of its own.
+	sessions := make([]tls.ClientSessionCache, sessionTicketKeyCount)
+	for i := range sessions {
+		sessions[i] = tls.NewLRUClientSessionCache(1)
+		if _, err = resumedHandshake(addrs[0], sessions[i]); err != nil {
+			t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+		}
+	}
+	for i := 1; i < sessionTicketKeyCount; i++ {
+		server.RotateSessionTicketKeys()
+		if resumed, err := resumedHandshake(addrs[0], sessions[i]); err != nil || !resumed {
+			t.Errorf("Expected the session to be resumed after %v rotations, received '%v' ('%v').", i, resumed, err)
+		}
+	}
+	server.RotateSessionTicketKeys()
+	if resumed, err := resumedHandshake(addrs[0], sessions[0]); err != nil || resumed {
+		t.Errorf("Expected the session to not be resumed once its key was rotated out, received '%v' ('%v').", resumed, err)
+	}
+}
+
+func TestSetSessionTicketKeyRotation(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.SetSessionTicketKeyRotation(10 * time.Millisecond)
+
+	// Ensure that the keys are rotated on schedule, and stop being rotated
+	// once rotation is stopped.
+	listener := server.listeners.listeners[0]
+	keyCount := func() int {
+		listener.tlsMutex.RLock()
+		defer listener.tlsMutex.RUnlock()
+		return len(listener.ticketKeys)
+	}
+	for i := 0; i < 100 && keyCount() < sessionTicketKeyCount; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if count := keyCount(); count != sessionTicketKeyCount {
+		t.Errorf("Expected %v session ticket keys, received '%v'.", sessionTicketKeyCount, count)
+	}
+	server.SetSessionTicketKeyRotation(0)
+	listener.tlsMutex.RLock()
+	key := listener.ticketKeys[0]
+	listener.tlsMutex.RUnlock()
+	time.Sleep(50 * time.Millisecond)
+	listener.tlsMutex.RLock()
+	if listener.ticketKeys[0] != key {
+		t.Error("Expected the session ticket key to not change once rotation stopped.")
+	}
+	listener.tlsMutex.RUnlock()
+}
+
+func TestSetSessionTicketKeys(t *testing.T) {
+	var err error
+	first, second := testServer(), testServer()
+	defer first.Shutdown()
+	defer second.Shutdown()
+
+	for i, server := range []*Server{first, second} {
+		if err = server.Listen(addrs[i]); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+		if err = server.AddTLSCertificateFromFile("./test/srv1.localhost.crt", "./test/srv1.localhost.key"); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+		server.Serve()
+	}
+
+	// Ensure that sessions can not be resumed across servers by default.
+	cache := tls.NewLRUClientSessionCache(1)
+	if _, err = resumedHandshake(addrs[0], cache); err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	if resumed, err := resumedHandshake(addrs[1], cache); err != nil || resumed {
+		t.Errorf("Expected the session to not be resumed, received '%v' ('%v').", resumed, err)
+	}
+
+	// Ensure that sessions can be resumed across servers sharing keys.
+	key := [32]byte{1, 2, 3}
+	first.SetSessionTicketKeys(key)
+	second.SetSessionTicketKeys(key)
+	cache = tls.NewLRUClientSessionCache(1)
+	if _, err = resumedHandshake(addrs[0], cache); err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	if resumed, err := resumedHandshake(addrs[1], cache); err != nil || !resumed {
+		t.Errorf("Expected the session to be resumed, received '%v' ('%v').", resumed, err)
+	}
+}
+
+// resumedHandshake performs a TLS 1.2 handshake with the given server, using
+// the provided session cache, and returns whether the session was resumed.
+func resumedHandshake(addr string, cache tls.ClientSessionCache) (bool, error) {
+	c, err := tls.Dial("tcp", addr, &tls.Config{
+		ServerName:         "srv1.localhost",
+		RootCAs:            httpTransport.TLSClientConfig.RootCAs,
+		MaxVersion:         tls.VersionTLS12,
+		ClientSessionCache: cache,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	return c.ConnectionState().DidResume, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+)
+
+// OriginalDestination returns the address that the client of the provided
+// request originally connected to.  For connections that were redirected to
+// the server via NAT, this is the destination before translation.  For other
+// connections, including those accepted by a transparent listener, it is the
+// local address of the connection.
+func OriginalDestination(r *http.Request) (net.Addr, error) {
+	c, ok := r.Context().Value(connContextKey{}).(*conn)
+	if !ok {
+		return nil, errors.New("server: request was not received by a managed listener")
+	}
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		if addr, err := originalDestination(tcpConn); err == nil {
+			return addr, nil
+		}
+	}
+	return c.LocalAddr(), nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// soOriginalDst is the SO_ORIGINAL_DST socket option, which netfilter uses to
+// report the destination of a connection before NAT.  The IPv6 equivalent,
+// IP6T_SO_ORIGINAL_DST, has the same value.
+const soOriginalDst = 80
+
+// ipv6Transparent is the IPV6_TRANSPARENT socket option, which the syscall
+// package does not define.
+const ipv6Transparent = 75
+
+// ListenTransparent announces on the provided network address with
+// IP_TRANSPARENT set on the socket, which allows it to accept connections
+// destined for any address that is routed to the local machine.  This
+// requires the CAP_NET_ADMIN capability, as well as routing rules that
+// deliver the traffic locally, typically an iptables TPROXY rule along with a
+// policy route for the marked packets.
+func ListenTransparent(network, addr string) (net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if err == nil && network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	return config.Listen(context.Background(), network, addr)
+}
+
+// originalDestination uses SO_ORIGINAL_DST to look up the destination of the
+// provided connection before NAT.
+func originalDestination(c *net.TCPConn) (net.Addr, error) {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	controlErr := rawConn.Control(func(fd uintptr) {
+		// There are no dedicated wrappers for retrieving a socket address, so
+		// use wrappers for structures that are large enough to hold one.
+		if local, ok := c.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+			var info *syscall.IPv6MTUInfo
+			if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err == nil {
+				// The port is stored in network byte order.
+				var port [2]byte
+				binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+				addr = &net.TCPAddr{
+					IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+			return
+		}
+		var mreq *syscall.IPv6Mreq
+		if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+			// The result is a sockaddr_in: family, port, and address.
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+		}
+	})
+	if controlErr != nil {
+		return nil, controlErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return addr, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestTransparent(t *testing.T) {
+	server := testServer()
+	defer server.Shutdown()
+
+	server.Transparent = true
+	server.ServeMux.HandleFunc("/original-destination", func(w http.ResponseWriter, req *http.Request) {
+		addr, err := OriginalDestination(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, addr)
+	})
+	if err := server.Listen(addrs[0]); err != nil {
+		if os.IsPermission(err) {
+			t.Skip("Skipping, as setting IP_TRANSPARENT requires CAP_NET_ADMIN.")
+		}
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that IP_TRANSPARENT was set on the listening socket.
+	rawConn, err := server.listeners.listeners[0].Listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatalf("Expected no error accessing the socket, received '%v'.", err)
+	}
+	rawConn.Control(func(fd uintptr) {
+		value, err := syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+		if err != nil {
+			t.Errorf("Expected no error reading IP_TRANSPARENT, received '%v'.", err)
+		} else if value != 1 {
+			t.Errorf("Expected IP_TRANSPARENT to be '1', received '%v'.", value)
+		}
+	})
+
+	// Without NAT, the original destination is the address that was
+	// connected to.
+	resp, err := http.Get("http://" + addrs[0] + "/original-destination")
+	if err != nil {
+		t.Fatalf("Expected no error from %v, received '%v'.", addrs[0], err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Expected no error reading from %v, received '%v'.", addrs[0], err)
+	}
+	if resp.StatusCode != 200 || strings.TrimSpace(string(body)) != addrs[0] {
+		t.Errorf("Expected original destination '%v', received '%v' (%v).", addrs[0], string(body), resp.StatusCode)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// errTransparentUnsupported is returned when transparent proxying is not
+// supported on the current platform.
+var errTransparentUnsupported = errors.New("server: transparent listening is only supported on Linux")
+
+// ListenTransparent announces on the provided network address with
+// IP_TRANSPARENT set on the socket.  It is only supported on Linux, and
+// returns an error on other platforms.
+func ListenTransparent(network, addr string) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+// originalDestination looks up the destination of the provided connection
+// before NAT.  It is only supported on Linux.
+func originalDestination(c *net.TCPConn) (net.Addr, error) {
+	return nil, errTransparentUnsupported
+}
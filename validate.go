@@ -0,0 +1,137 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ValidationErrors is a list of problems found while validating the server's
+// configuration.
+type ValidationErrors []error
+
+// Error implements the Error() method of the error interface.
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return "invalid configuration: " + strings.Join(msgs, "; ")
+}
+
+// Validate checks the server's configuration without serving any connections.
+// It verifies that there is a handler, that each listener is able to accept
+// connections, and that each TLS configuration has valid certificates and
+// usable protocol versions and cipher suites.  All problems found are returned
+// as a ValidationErrors.
+func (s *Server) Validate() error {
+	var errs ValidationErrors
+	if s.ServeMux == nil {
+		errs = append(errs, errors.New("no handler configured"))
+	}
+
+	s.tlsMutex.RLock()
+	if s.TLS != nil {
+		errs = append(errs, validateTLS("server", s.TLS)...)
+	}
+	s.tlsMutex.RUnlock()
+
+	s.listeners.RLock()
+	for _, listener := range s.listeners.listeners {
+		if listener.hasState(stateClosing) {
+			continue
+		}
+		addr := listener.address()
+		if err := listener.check(); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", addr, err))
+		}
+		listener.tlsMutex.RLock()
+		if listener.ownTLS {
+			errs = append(errs, validateTLS(addr, listener.tlsConfig)...)
+		}
+		listener.tlsMutex.RUnlock()
+	}
+	s.listeners.RUnlock()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateTLS checks the provided TLS configuration, and returns any problems
+// found.  Each problem is prefixed with the provided name.
+func validateTLS(name string, config *tls.Config) []error {
+	var errs []error
+	now := time.Now()
+	for i, cert := range config.Certificates {
+		leaf, err := leafCertificate(cert)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: certificate %d can not be parsed: %v", name, i, err))
+			continue
+		}
+		if err := checkValidityPeriod(leaf, now); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", name, err))
+		}
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		errs = append(errs, fmt.Errorf("%v: no certificates configured", name))
+	}
+
+	minVersion, maxVersion := config.MinVersion, config.MaxVersion
+	if minVersion == 0 {
+		// This is the minimum crypto/tls uses for servers by default.
+		minVersion = tls.VersionTLS12
+	}
+	if maxVersion == 0 {
+		maxVersion = tls.VersionTLS13
+	}
+	if minVersion > maxVersion {
+		errs = append(errs, fmt.Errorf("%v: minimum TLS version %v is greater than maximum version %v",
+			name, tls.VersionName(minVersion), tls.VersionName(maxVersion)))
+	} else if maxVersion < tls.VersionTLS13 && config.CipherSuites != nil &&
+		!hasUsableCipherSuite(config.CipherSuites, minVersion, maxVersion) {
+		// TLS 1.3 cipher suites are not configurable, so the configured
+		// cipher suites only matter when TLS 1.3 is disabled.
+		errs = append(errs, fmt.Errorf("%v: no configured cipher suite supports TLS versions %v through %v",
+			name, tls.VersionName(minVersion), tls.VersionName(maxVersion)))
+	}
+	return errs
+}
+
+// checkValidityPeriod returns an error if the provided certificate is not valid
+// at the provided time.
+func checkValidityPeriod(leaf *x509.Certificate, now time.Time) error {
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate for %v is not valid until %v", leaf.Subject.CommonName, leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate for %v expired at %v", leaf.Subject.CommonName, leaf.NotAfter)
+	}
+	return nil
+}
+
+// hasUsableCipherSuite returns true if any of the provided cipher suites are
+// supported by the crypto/tls package for a TLS version between minVersion and
+// maxVersion.
+func hasUsableCipherSuite(ids []uint16, minVersion, maxVersion uint16) bool {
+	supported := make(map[uint16][]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		supported[suite.ID] = suite.SupportedVersions
+	}
+	for _, id := range ids {
+		for _, version := range supported[id] {
+			if version >= minVersion && version <= maxVersion {
+				return true
+			}
+		}
+	}
+	return false
+}
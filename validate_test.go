@@ -0,0 +1,124 @@
+// Copyright 2013 Ryan Rogers. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	for _, addr := range addrs {
+		if err = server.Listen(addr); err != nil {
+			t.Fatalf("Expected no error when listening, received '%v'.", err)
+		}
+	}
+	for certFile, keyFile := range keyPairs {
+		if err = server.AddTLSCertificateFromFile(certFile, keyFile); err != nil {
+			t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+		}
+	}
+
+	// Ensure that a valid configuration passes.
+	if err = server.Validate(); err != nil {
+		t.Fatalf("Expected no error when validating, received '%v'.", err)
+	}
+
+	// Break the configuration in several ways.
+	server.AllowInvalidCertificates = true
+	if err = server.AddTLSCertificateFromFile("./test/expired.localhost.crt", "./test/expired.localhost.key"); err != nil {
+		t.Fatalf("Expected no error when adding TLS certificate, received '%v'.", err)
+	}
+	server.TLS.MinVersion = tls.VersionTLS13
+	server.TLS.MaxVersion = tls.VersionTLS12
+	server.listeners.listeners[0].Listener.Close()
+
+	// Ensure that every problem is reported.
+	err = server.Validate()
+	validationErrs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("Expected a ValidationErrors error, received '%v'.", err)
+	}
+	if len(validationErrs) != 3 {
+		t.Errorf("Expected three problems, received '%v'.", err)
+	}
+	for _, expected := range []string{"expired.localhost expired", "minimum TLS version", addrs[0]} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected a problem mentioning '%v', received '%v'.", expected, err)
+		}
+	}
+
+	// Ensure that no listener was started.
+	for _, listener := range server.listeners.listeners {
+		if listener.hasState(stateServing) {
+			t.Error("Expected listeners to not be serving connections.")
+		}
+	}
+}
+
+func TestValidateWhileServing(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+	server.Serve()
+	if err = httpRequestSuccess(addrs[0], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that validating does not disturb a serving listener.
+	if err = server.Validate(); err != nil {
+		t.Fatalf("Expected no error when validating, received '%v'.", err)
+	}
+	if err = httpRequestSuccess(addrs[0], simpleRoute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateKeepsPendingConnections(t *testing.T) {
+	var err error
+	server := testServer()
+	defer server.Shutdown()
+
+	if err = server.Listen(addrs[0]); err != nil {
+		t.Fatalf("Expected no error when listening, received '%v'.", err)
+	}
+
+	// Connect before the listener is serving, so that the connection is
+	// waiting to be accepted while validating.
+	c, err := net.Dial("tcp", addrs[0])
+	if err != nil {
+		t.Fatalf("Expected no error when connecting, received '%v'.", err)
+	}
+	defer c.Close()
+	if err = server.Validate(); err != nil {
+		t.Fatalf("Expected no error when validating, received '%v'.", err)
+	}
+	server.Serve()
+
+	// Ensure that the connection was not accepted and dropped by validating.
+	if _, err = c.Write([]byte("GET " + simpleRoute + " HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatalf("Expected no error when writing the request, received '%v'.", err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 12)
+	if _, err = io.ReadFull(c, buf); err != nil {
+		t.Fatalf("Expected a response to the pending connection, received '%v'.", err)
+	}
+	if status := string(buf); status != "HTTP/1.0 200" {
+		t.Errorf("Expected a '200' response, received '%v'.", status)
+	}
+}